@@ -0,0 +1,289 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"telegram-message-receiver/handler"
+	"telegram-message-receiver/storage"
+)
+
+// maxPageSize caps the limit parameter of the message history
+const maxPageSize = 1000
+
+// maxReplyBody caps the size of a reply request; Telegram messages are at most 4096 characters
+const maxReplyBody = 64 << 10
+
+// messagePage is the body of a message history response. NextOffset is set while more
+// messages match the filter.
+type messagePage struct {
+	Messages   []storage.Message `json:"messages"`
+	Offset     int               `json:"offset"`
+	Limit      int               `json:"limit"`
+	NextOffset *int              `json:"next_offset,omitempty"`
+}
+
+// replyRequest is the body of a reply sent through POST /api/chats/{chatID}/messages
+type replyRequest struct {
+	Text      string `json:"text"`
+	ReplyToID int    `json:"reply_to_id"`
+}
+
+// contact is a shared contact as listed by /api/contacts
+type contact struct {
+	ChatID int64 `json:"chat_id"`
+	storage.ContactInfo
+}
+
+func (s *Server) listChats(w http.ResponseWriter, r *http.Request) {
+	chats, err := s.storage.ListChats(r.Context())
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, chats)
+}
+
+func (s *Server) listContacts(w http.ResponseWriter, r *http.Request) {
+	chats, err := s.storage.ListChats(r.Context())
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	contacts := []contact{}
+	for _, chat := range chats {
+		if chat.PhoneNumber == "" {
+			continue
+		}
+		info, err := s.storage.GetContact(r.Context(), chat.ChatID)
+		if err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+		contacts = append(contacts, contact{ChatID: chat.ChatID, ContactInfo: info})
+	}
+	writeJSON(w, http.StatusOK, contacts)
+}
+
+func (s *Server) getContact(w http.ResponseWriter, r *http.Request, chatParam string) {
+	chatID, err := strconv.ParseInt(chatParam, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid chat ID")
+		return
+	}
+
+	info, err := s.storage.GetContact(r.Context(), chatID)
+	if errors.Is(err, storage.ErrContactNotFound) {
+		writeError(w, http.StatusNotFound, "contact not found")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, contact{ChatID: chatID, ContactInfo: info})
+}
+
+// listMessages returns a page of a chat's history. Query parameters: since and until (RFC 3339
+// or Unix seconds), kind (repeated or comma separated), q (text to search for), order (asc or
+// desc), limit and offset.
+func (s *Server) listMessages(w http.ResponseWriter, r *http.Request, chatParam string) {
+	chatID, err := strconv.ParseInt(chatParam, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid chat ID")
+		return
+	}
+
+	filter, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.ChatID = chatID
+
+	messages, err := s.storage.ListMessages(r.Context(), filter)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	page := messagePage{Messages: messages, Offset: filter.Offset, Limit: filter.Limit}
+	if len(messages) == filter.Limit {
+		next := filter.Offset + filter.Limit
+		page.NextOffset = &next
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// sendReply sends an operator's reply to a chat and returns it as stored in the history
+func (s *Server) sendReply(w http.ResponseWriter, r *http.Request, chatParam string) {
+	chatID, err := strconv.ParseInt(chatParam, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid chat ID")
+		return
+	}
+
+	var request replyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReplyBody)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	reply, err := s.replies.SendReply(r.Context(), chatID, request.Text, request.ReplyToID)
+	switch {
+	case errors.Is(err, handler.ErrInvalidReply):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, handler.ErrReplyNotSent):
+		writeError(w, http.StatusBadGateway, err.Error())
+	case err != nil && reply.MessageID != 0:
+		// Reported apart from other failures so the reply isn't sent twice by retrying
+		s.logger.Error("API request failed", "path", r.URL.Path, "error", err)
+		writeError(w, http.StatusInternalServerError, "reply was sent but could not be stored")
+	case err != nil:
+		s.internalError(w, r, err)
+	default:
+		writeJSON(w, http.StatusCreated, storage.Message{MessageInfo: reply.MessageInfo, Kind: storage.KindText, Text: reply.Text})
+	}
+}
+
+func parseFilter(r *http.Request) (storage.MessageFilter, error) {
+	query := r.URL.Query()
+	filter := storage.MessageFilter{Limit: storage.DefaultMessageLimit}
+
+	var err error
+	if filter.Since, err = parseTime(query.Get("since")); err != nil {
+		return filter, fmt.Errorf("invalid since: %w", err)
+	}
+	if filter.Until, err = parseTime(query.Get("until")); err != nil {
+		return filter, fmt.Errorf("invalid until: %w", err)
+	}
+
+	for _, value := range query["kind"] {
+		for _, kind := range strings.Split(value, ",") {
+			if kind = strings.TrimSpace(kind); kind != "" {
+				filter.Kinds = append(filter.Kinds, storage.MessageKind(kind))
+			}
+		}
+	}
+
+	filter.Search = query.Get("q")
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.NewestFirst = true
+	default:
+		return filter, fmt.Errorf("order must be asc or desc")
+	}
+
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > maxPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		if filter.Offset, err = strconv.Atoi(value); err != nil || filter.Offset < 0 {
+			return filter, fmt.Errorf("offset must be a non-negative number")
+		}
+	}
+	return filter, nil
+}
+
+// parseTime accepts RFC 3339 timestamps and Unix seconds; empty means no bound
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// getMedia streams the attachment of a message. Files on disk support range requests, so
+// audio and video can be played while they load.
+func (s *Server) getMedia(w http.ResponseWriter, r *http.Request, chatParam, messageParam string) {
+	chatID, err := strconv.ParseInt(chatParam, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid chat ID")
+		return
+	}
+	messageID, err := strconv.Atoi(messageParam)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid message ID")
+		return
+	}
+
+	media, err := s.storage.GetMedia(r.Context(), chatID, messageID)
+	if errors.Is(err, storage.ErrMediaNotFound) {
+		writeError(w, http.StatusNotFound, "media not found")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	defer media.Close()
+
+	if err := ServeMedia(w, r, media); err != nil {
+		s.logger.Warn("Media download interrupted", "path", r.URL.Path, "error", err)
+	}
+}
+
+// inlineTypes are the content types browsers may display in place. Attachments are named by
+// whoever sent them, so anything else, SVG included, could run script on the origin serving it.
+var inlineTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"audio/ogg":       true,
+	"audio/mpeg":      true,
+	"audio/mp4":       true,
+	"audio/wav":       true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/quicktime": true,
+}
+
+// ServeMedia writes an attachment as the response to r, with range request support if its
+// content is seekable. Images, audio and video of the types in inlineTypes are served inline
+// unless ?download=1 is set; everything else is always an opaque download. The returned error
+// is from copying the content, when the response is already under way.
+func ServeMedia(w http.ResponseWriter, r *http.Request, media *storage.Media) error {
+	contentType, disposition := media.ContentType(), "inline"
+	if !inlineTypes[contentType] {
+		contentType, disposition = "application/octet-stream", "attachment"
+	}
+	if r.URL.Query().Get("download") != "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": media.FileName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+
+	if seeker, ok := media.ReadCloser.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, media.FileName, time.Time{}, seeker)
+		return nil
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(media.Size, 10))
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err := io.Copy(w, media)
+	return err
+}
+
+func (s *Server) internalError(w http.ResponseWriter, r *http.Request, err error) {
+	s.logger.Error("API request failed", "path", r.URL.Path, "error", err)
+	writeError(w, http.StatusInternalServerError, "internal error")
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"telegram-message-receiver/handler"
+	"telegram-message-receiver/logger"
+	"telegram-message-receiver/storage"
+)
+
+func TestServeMedia(t *testing.T) {
+	tests := []struct {
+		fileName    string
+		query       string
+		contentType string
+		disposition string
+	}{
+		{"photo.jpg", "", "image/jpeg", "inline"},
+		{"voice.ogg", "", "audio/ogg", "inline"},
+		{"clip.mp4", "", "video/mp4", "inline"},
+		{"photo.jpg", "?download=1", "image/jpeg", "attachment"},
+		{"page.html", "", "application/octet-stream", "attachment"},
+		{"image.svg", "", "application/octet-stream", "attachment"},
+		{"script.js", "", "application/octet-stream", "attachment"},
+		{"notes", "", "application/octet-stream", "attachment"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fileName+tt.query, func(t *testing.T) {
+			media := &storage.Media{
+				FileName:   tt.fileName,
+				Size:       7,
+				ReadCloser: io.NopCloser(strings.NewReader("content")),
+			}
+			w := httptest.NewRecorder()
+			if err := ServeMedia(w, httptest.NewRequest("GET", "/media/1/2"+tt.query, nil), media); err != nil {
+				t.Fatal(err)
+			}
+
+			header := w.Header()
+			if got := header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := header.Get("Content-Disposition"); !strings.HasPrefix(got, tt.disposition+";") {
+				t.Errorf("Content-Disposition = %q, want %s", got, tt.disposition)
+			}
+			if got := header.Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+			}
+			if got := header.Get("Content-Security-Policy"); got != "sandbox" {
+				t.Errorf("Content-Security-Policy = %q, want sandbox", got)
+			}
+			if got := w.Body.String(); got != "content" {
+				t.Errorf("body = %q, want the content", got)
+			}
+		})
+	}
+}
+
+// fakeReplier answers SendReply with reply and err
+type fakeReplier struct {
+	reply storage.TextMessage
+	err   error
+}
+
+func (f fakeReplier) SendReply(ctx context.Context, chatID int64, text string, replyToID int) (storage.TextMessage, error) {
+	return f.reply, f.err
+}
+
+func TestSendReply(t *testing.T) {
+	sent := storage.TextMessage{MessageInfo: storage.MessageInfo{MessageID: 1001, ChatID: 5, Outbound: true}, Text: "hi"}
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		replier  fakeReplier
+		status   int
+		response string
+	}{
+		{"sent", "/api/chats/5/messages", `{"text":"hi"}`, fakeReplier{reply: sent}, http.StatusCreated, `"message_id":1001`},
+		{"invalid chat ID", "/api/chats/abc/messages", `{"text":"hi"}`, fakeReplier{reply: sent}, http.StatusBadRequest, "invalid chat ID"},
+		{"invalid body", "/api/chats/5/messages", `{"text":`, fakeReplier{reply: sent}, http.StatusBadRequest, "invalid request body"},
+		{"invalid reply", "/api/chats/5/messages", `{"text":"hi"}`,
+			fakeReplier{err: fmt.Errorf("%w: chat 5 is blocked", handler.ErrInvalidReply)}, http.StatusBadRequest, "chat 5 is blocked"},
+		{"not sent", "/api/chats/5/messages", `{"text":"hi"}`,
+			fakeReplier{err: fmt.Errorf("%w: chat not found", handler.ErrReplyNotSent)}, http.StatusBadGateway, "reply not sent"},
+		{"sent but not stored", "/api/chats/5/messages", `{"text":"hi"}`,
+			fakeReplier{reply: sent, err: errors.New("disk full")}, http.StatusInternalServerError, "reply was sent but could not be stored"},
+		{"failed", "/api/chats/5/messages", `{"text":"hi"}`,
+			fakeReplier{err: errors.New("database is locked")}, http.StatusInternalServerError, "internal error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log, err := logger.NewLoggerWithOutput(io.Discard, slog.LevelError.String(), "text")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := NewServer("", "token", nil, tt.replier, log)
+
+			w := httptest.NewRecorder()
+			s.route(w, httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if !strings.Contains(w.Body.String(), tt.response) {
+				t.Errorf("body %q, want it to contain %q", w.Body.String(), tt.response)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"telegram-message-receiver/logger"
+	"telegram-message-receiver/storage"
+)
+
+// Replier sends operator replies; it is implemented by *handler.MessageHandler
+type Replier interface {
+	SendReply(ctx context.Context, chatID int64, text string, replyToID int) (storage.TextMessage, error)
+}
+
+// Server serves the stored chats, contacts, messages and media as a JSON API under /api/,
+// and sends operator replies. Every request must carry the configured token as
+// "Authorization: Bearer <token>".
+type Server struct {
+	addr    string
+	token   string
+	storage storage.MessageStorage
+	replies Replier
+	logger  *logger.Logger
+	server  *http.Server
+}
+
+func NewServer(addr, token string, storage storage.MessageStorage, replies Replier, logger *logger.Logger) *Server {
+	return &Server{
+		addr:    addr,
+		token:   token,
+		storage: storage,
+		replies: replies,
+		logger:  logger,
+	}
+}
+
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", s.authorize(http.HandlerFunc(s.route)))
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("API server stopped", "error", err)
+		}
+	}()
+
+	s.logger.Info("Serving API", "addr", s.addr)
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	if err := s.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down API server: %w", err)
+	}
+	return nil
+}
+
+// authorize rejects requests without the bearer token
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// route dispatches /api/ requests by their path segments:
+//
+//	GET  /api/chats
+//	GET  /api/chats/{chatID}/messages
+//	POST /api/chats/{chatID}/messages
+//	GET  /api/chats/{chatID}/messages/{messageID}/media
+//	GET  /api/contacts
+//	GET  /api/contacts/{chatID}
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+	messages := len(parts) == 3 && parts[0] == "chats" && parts[2] == "messages"
+
+	if messages && r.Method == http.MethodPost {
+		s.sendReply(w, r, parts[1])
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		if messages {
+			w.Header().Set("Allow", "GET, HEAD, POST")
+		} else {
+			w.Header().Set("Allow", "GET, HEAD")
+		}
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "chats":
+		s.listChats(w, r)
+	case messages:
+		s.listMessages(w, r, parts[1])
+	case len(parts) == 5 && parts[0] == "chats" && parts[2] == "messages" && parts[4] == "media":
+		s.getMedia(w, r, parts[1], parts[3])
+	case len(parts) == 1 && parts[0] == "contacts":
+		s.listContacts(w, r)
+	case len(parts) == 2 && parts[0] == "contacts":
+		s.getContact(w, r, parts[1])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
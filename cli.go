@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"telegram-message-receiver/config"
+	"telegram-message-receiver/deadletter"
+	"telegram-message-receiver/handler"
+	"telegram-message-receiver/logger"
+	"telegram-message-receiver/storage"
+)
+
+// runCommand executes a maintenance subcommand instead of starting the bot
+func runCommand(name string, args []string) error {
+	switch name {
+	case "migrate-texts":
+		return migrateTexts(args)
+	case "deadletter":
+		return deadLetterCommand(args)
+	case "delete-media":
+		return deleteMedia(args)
+	case "reply":
+		return reply(args)
+	case "healthcheck":
+		return healthcheck()
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+func migrateTexts(args []string) error {
+	flags := flag.NewFlagSet("migrate-texts", flag.ExitOnError)
+	storagePath := flags.String("storage-path", config.GetEnvWithDefault("STORAGE_PATH", config.DefaultStoragePath), "directory containing the texts/ folder")
+	flags.Parse(args)
+
+	count, err := storage.MigrateLegacyTexts(*storagePath)
+	if err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+
+	fmt.Printf("Migrated %d text messages\n", count)
+	return nil
+}
+
+// deleteMedia removes the attachment of a stored message, keeping content other messages share
+func deleteMedia(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: delete-media <chat-id> <message-id>")
+	}
+	chatID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID %q", args[0])
+	}
+	messageID, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid message ID %q", args[1])
+	}
+
+	config, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+
+	logger, err := logger.NewLogger(config.LogLevel, config.LogFormat)
+	if err != nil {
+		return fmt.Errorf("error creating logger: %w", err)
+	}
+
+	storage, err := newStorage(config, logger)
+	if err != nil {
+		return fmt.Errorf("error opening storage: %w", err)
+	}
+	defer storage.Close()
+
+	if err := storage.DeleteMedia(context.Background(), chatID, messageID); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted media of message %d in chat %d\n", messageID, chatID)
+	return nil
+}
+
+// reply sends an operator's reply to a chat and stores it in the chat's history. The text is
+// read from standard input when it isn't given as arguments.
+func reply(args []string) error {
+	flags := flag.NewFlagSet("reply", flag.ExitOnError)
+	replyToID := flags.Int("reply-to", 0, "ID of a stored message of the chat to reply to")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("usage: reply [-reply-to <message-id>] <chat-id> [text]")
+	}
+	chatID, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID %q", flags.Arg(0))
+	}
+
+	text := strings.Join(flags.Args()[1:], " ")
+	if text == "" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("error reading reply: %w", err)
+		}
+		text = strings.TrimRight(string(data), "\n")
+	}
+
+	config, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+
+	logger, err := logger.NewLogger(config.LogLevel, config.LogFormat)
+	if err != nil {
+		return fmt.Errorf("error creating logger: %w", err)
+	}
+
+	bot, err := newBot(config)
+	if err != nil {
+		return fmt.Errorf("error starting bot: %w", err)
+	}
+
+	storage, err := newStorage(config, logger)
+	if err != nil {
+		return fmt.Errorf("error opening storage: %w", err)
+	}
+	defer storage.Close()
+
+	// Replies are plain text, so nothing is transcribed or transcoded
+	handler := handler.NewMessageHandler(bot, config, storage, nil, nil, logger)
+	sent, err := handler.SendReply(context.Background(), chatID, text, *replyToID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sent message %d to chat %d\n", sent.MessageID, chatID)
+	return nil
+}
+
+// healthcheck fails unless the bot running with the same configuration reports itself live on
+// HEALTH_ADDR. It is the Docker image's HEALTHCHECK, which can't know the address on its own.
+func healthcheck() error {
+	config, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+
+	host, port, err := net.SplitHostPort(config.HealthAddr)
+	if err != nil {
+		return fmt.Errorf("invalid HEALTH_ADDR %q: %w", config.HealthAddr, err)
+	}
+	// A server listening on all interfaces is reachable on loopback
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + "/healthz")
+	if err != nil {
+		return fmt.Errorf("health check failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unhealthy: %s", resp.Status)
+	}
+	return nil
+}
+
+// deadLetterCommand lists, inspects, replays or discards dead-lettered updates
+func deadLetterCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: deadletter list | show <update-id> | replay <update-id> | discard <update-id>")
+	}
+
+	config, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	store := deadletter.NewStore(config.DeadLetterPath, config.DeadLetterRetryDelay)
+
+	if args[0] == "list" {
+		return listDeadLetters(store)
+	}
+
+	if len(args) != 2 {
+		return fmt.Errorf("usage: deadletter %s <update-id>", args[0])
+	}
+	updateID, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid update ID %q", args[1])
+	}
+
+	switch args[0] {
+	case "show":
+		entry, err := store.Get(updateID)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(entry, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	case "replay":
+		return replayDeadLetter(config, store, updateID)
+	case "discard":
+		if err := store.Remove(updateID); err != nil {
+			return err
+		}
+		fmt.Printf("Discarded update %d\n", updateID)
+		return nil
+	default:
+		return fmt.Errorf("unknown deadletter command %q", args[0])
+	}
+}
+
+func listDeadLetters(store *deadletter.Store) error {
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "UPDATE ID\tATTEMPTS\tLAST FAILED\tNEXT ATTEMPT\tERROR")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", entry.UpdateID, entry.Attempts,
+			entry.LastFailed.Format(time.RFC3339), entry.NextAttempt.Format(time.RFC3339), entry.Error)
+	}
+	return w.Flush()
+}
+
+// replayDeadLetter handles a dead-lettered update right away, removing it on success
+func replayDeadLetter(cfg *config.Config, store *deadletter.Store, updateID int) error {
+	entry, err := store.Get(updateID)
+	if err != nil {
+		return err
+	}
+	update, err := entry.DecodeUpdate()
+	if err != nil {
+		return err
+	}
+
+	logger, err := logger.NewLogger(cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		return fmt.Errorf("error creating logger: %w", err)
+	}
+
+	bot, err := newBot(cfg)
+	if err != nil {
+		return fmt.Errorf("error starting bot: %w", err)
+	}
+
+	storage, err := newStorage(cfg, logger)
+	if err != nil {
+		return fmt.Errorf("error opening storage: %w", err)
+	}
+	defer storage.Close()
+
+	transcoder, err := newTranscoder(cfg)
+	if err != nil {
+		return fmt.Errorf("error configuring transcoding: %w", err)
+	}
+
+	handler := handler.NewMessageHandler(bot, cfg, storage, newTranscriber(cfg), transcoder, logger)
+	if err := handler.HandleUpdate(context.Background(), update); err != nil {
+		if err := store.Add(update, err); err != nil {
+			logger.Error("Error updating dead letter", "error", err)
+		}
+		return fmt.Errorf("replay of update %d failed: %w", updateID, err)
+	}
+
+	if err := store.Remove(updateID); err != nil {
+		return err
+	}
+	fmt.Printf("Replayed update %d\n", updateID)
+	return nil
+}
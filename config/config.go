@@ -3,7 +3,10 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -11,31 +14,288 @@ type Config struct {
 	StoragePath           string
 	BaseFileURL           string
 	Debug                 bool
+	LogLevel              string
+	LogFormat             string
 	SendAcknowledgment    bool
 	AcknowledgmentMessage string
 	MaxFileSize           int64
 	AllowedFileTypes      []string
+
+	// Telegram user IDs allowed to use the admin commands
+	AdminUserIDs []int64
+
+	// Update delivery: "polling" (default) or "webhook"
+	UpdateMode         string
+	WebhookURL         string
+	WebhookListenAddr  string
+	WebhookPath        string
+	WebhookSecretToken string
+	WebhookCertFile    string
+	WebhookKeyFile     string
+	WebhookUploadCert  bool
+
+	// Storage backend: "local" (default), "sqlite" or "postgres"
+	StorageBackend     string
+	SQLitePath         string
+	SQLiteStoreMediaDB bool
+
+	// PostgreSQL connection and pool size for the postgres backend
+	PostgresDSN             string
+	PostgresMaxConns        int
+	PostgresMaxIdleConns    int
+	PostgresConnMaxLifetime time.Duration
+
+	// Where the sqlite and postgres backends keep media content unless it is stored in the database:
+	// "file" (default, under StoragePath) or "s3", an S3-compatible bucket
+	MediaBackend      string
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3Prefix          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3PathStyle       bool
+
+	// Concurrent update processing
+	WorkerCount     int
+	WorkerQueueSize int
+
+	// How long shutdown waits for in-flight messages before aborting them
+	ShutdownTimeout time.Duration
+
+	// Address of the Prometheus metrics server; empty disables it
+	MetricsAddr string
+
+	// Address of the REST API over the stored messages, and the bearer token it requires;
+	// an empty address disables it
+	APIAddr  string
+	APIToken string
+
+	// Address of the web inbox and the basic auth credentials it requires; an empty address
+	// disables it
+	WebUIAddr     string
+	WebUIUsername string
+	WebUIPassword string
+
+	// Address of the /healthz and /readyz server, and how long polling may go without a
+	// successful getUpdates call before the bot is reported unhealthy
+	HealthAddr       string
+	HealthMaxPollAge time.Duration
+
+	// HTTP timeouts: Telegram API requests (must outlast the 60 second long poll), file
+	// downloads, and connecting to either
+	APITimeout      time.Duration
+	DownloadTimeout time.Duration
+	ConnectTimeout  time.Duration
+
+	// Retries of file downloads and Telegram API calls, with exponential backoff
+	RetryAttempts  int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// Updates that failed to process are kept under DeadLetterPath and retried in the
+	// background, DeadLetterRetryDelay after the first failure and doubling from there
+	DeadLetterPath        string
+	DeadLetterRetryDelay  time.Duration
+	DeadLetterMaxAttempts int
+
+	// Voice message transcription: "" (disabled) or "whisper", which runs a local whisper.cpp binary
+	Transcriber       string
+	WhisperBinary     string
+	WhisperModel      string
+	WhisperLanguage   string
+	TranscribeTimeout time.Duration
+	TranscribeReply   bool
+
+	// Formats voice messages are converted to with ffmpeg besides the original ("wav", "mp3");
+	// empty disables transcoding
+	TranscodeFormats []string
+	FFmpegBinary     string
+	TranscodeTimeout time.Duration
 }
 
+const (
+	UpdateModePolling = "polling"
+	UpdateModeWebhook = "webhook"
+
+	StorageBackendLocal    = "local"
+	StorageBackendSQLite   = "sqlite"
+	StorageBackendPostgres = "postgres"
+
+	MediaBackendFile = "file"
+	MediaBackendS3   = "s3"
+
+	TranscriberWhisper = "whisper"
+
+	// DefaultStoragePath is where files are stored when STORAGE_PATH is unset
+	DefaultStoragePath = "messages"
+)
+
 func LoadConfig() (*Config, error) {
 	config := &Config{
-		TelegramToken:         os.Getenv("TELEGRAM_BOT_TOKEN"),
-		StoragePath:           getEnvWithDefault("STORAGE_PATH", "messages"),
-		BaseFileURL:           getEnvWithDefault("TELEGRAM_FILE_BASE_URL", "https://api.telegram.org/file/bot%s/%s"),
-		Debug:                 os.Getenv("DEBUG") == "true",
-		SendAcknowledgment:    getEnvWithDefault("SEND_ACKNOWLEDGMENT", "true") == "true",
-		AcknowledgmentMessage: getEnvWithDefault("ACKNOWLEDGMENT_MESSAGE", "Message received!"),
-		MaxFileSize:           getEnvAsInt64("MAX_FILE_SIZE", 20*1024*1024), // 20MB default
+		TelegramToken:           os.Getenv("TELEGRAM_BOT_TOKEN"),
+		StoragePath:             GetEnvWithDefault("STORAGE_PATH", DefaultStoragePath),
+		BaseFileURL:             GetEnvWithDefault("TELEGRAM_FILE_BASE_URL", "https://api.telegram.org/file/bot%s/%s"),
+		Debug:                   os.Getenv("DEBUG") == "true",
+		SendAcknowledgment:      GetEnvWithDefault("SEND_ACKNOWLEDGMENT", "true") == "true",
+		AcknowledgmentMessage:   GetEnvWithDefault("ACKNOWLEDGMENT_MESSAGE", "Message received!"),
+		MaxFileSize:             getEnvAsInt64("MAX_FILE_SIZE", 20*1024*1024), // 20MB default
+		AllowedFileTypes:        parseFileTypes(os.Getenv("ALLOWED_FILE_TYPES")),
+		UpdateMode:              GetEnvWithDefault("UPDATE_MODE", UpdateModePolling),
+		WebhookURL:              os.Getenv("WEBHOOK_URL"),
+		WebhookListenAddr:       GetEnvWithDefault("WEBHOOK_LISTEN_ADDR", ":8443"),
+		WebhookPath:             GetEnvWithDefault("WEBHOOK_PATH", "/webhook"),
+		WebhookSecretToken:      os.Getenv("WEBHOOK_SECRET_TOKEN"),
+		WebhookCertFile:         os.Getenv("WEBHOOK_TLS_CERT"),
+		WebhookKeyFile:          os.Getenv("WEBHOOK_TLS_KEY"),
+		WebhookUploadCert:       os.Getenv("WEBHOOK_UPLOAD_CERT") == "true",
+		StorageBackend:          GetEnvWithDefault("STORAGE_BACKEND", StorageBackendLocal),
+		SQLiteStoreMediaDB:      os.Getenv("SQLITE_STORE_MEDIA_IN_DB") == "true",
+		PostgresDSN:             os.Getenv("POSTGRES_DSN"),
+		PostgresMaxConns:        int(getEnvAsInt64("POSTGRES_MAX_CONNS", 10)),
+		PostgresConnMaxLifetime: getEnvAsDuration("POSTGRES_CONN_MAX_LIFETIME", 30*time.Minute),
+		MediaBackend:            GetEnvWithDefault("MEDIA_BACKEND", MediaBackendFile),
+		S3Region:                GetEnvWithDefault("S3_REGION", "us-east-1"),
+		S3Bucket:                os.Getenv("S3_BUCKET"),
+		S3Prefix:                os.Getenv("S3_PREFIX"),
+		S3AccessKeyID:           os.Getenv("S3_ACCESS_KEY_ID"),
+		S3SecretAccessKey:       os.Getenv("S3_SECRET_ACCESS_KEY"),
+		S3PathStyle:             os.Getenv("S3_PATH_STYLE") == "true",
+		WorkerCount:             int(getEnvAsInt64("WORKER_COUNT", 4)),
+		WorkerQueueSize:         int(getEnvAsInt64("WORKER_QUEUE_SIZE", 100)),
+		ShutdownTimeout:         getEnvAsDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		MetricsAddr:             os.Getenv("METRICS_ADDR"),
+		HealthAddr:              GetEnvWithDefault("HEALTH_ADDR", ":8080"),
+		HealthMaxPollAge:        getEnvAsDuration("HEALTH_MAX_POLL_AGE", 3*time.Minute),
+		APIAddr:                 os.Getenv("API_ADDR"),
+		APIToken:                os.Getenv("API_TOKEN"),
+		WebUIAddr:               os.Getenv("WEBUI_ADDR"),
+		WebUIUsername:           GetEnvWithDefault("WEBUI_USERNAME", "admin"),
+		WebUIPassword:           os.Getenv("WEBUI_PASSWORD"),
+		APITimeout:              getEnvAsDuration("TELEGRAM_API_TIMEOUT", 90*time.Second),
+		DownloadTimeout:         getEnvAsDuration("DOWNLOAD_TIMEOUT", 5*time.Minute),
+		ConnectTimeout:          getEnvAsDuration("HTTP_CONNECT_TIMEOUT", 10*time.Second),
+		RetryAttempts:           int(getEnvAsInt64("RETRY_ATTEMPTS", 5)),
+		RetryBaseDelay:          getEnvAsDuration("RETRY_BASE_DELAY", time.Second),
+		RetryMaxDelay:           getEnvAsDuration("RETRY_MAX_DELAY", 30*time.Second),
+		DeadLetterRetryDelay:    getEnvAsDuration("DEADLETTER_RETRY_DELAY", 5*time.Minute),
+		DeadLetterMaxAttempts:   int(getEnvAsInt64("DEADLETTER_MAX_ATTEMPTS", 10)),
+		Transcriber:             os.Getenv("TRANSCRIBER"),
+		WhisperBinary:           GetEnvWithDefault("WHISPER_BINARY", "whisper-cli"),
+		WhisperModel:            os.Getenv("WHISPER_MODEL"),
+		WhisperLanguage:         GetEnvWithDefault("WHISPER_LANGUAGE", "auto"),
+		TranscribeTimeout:       getEnvAsDuration("TRANSCRIBE_TIMEOUT", 5*time.Minute),
+		TranscribeReply:         os.Getenv("TRANSCRIBE_REPLY") == "true",
+		TranscodeFormats:        parseList(os.Getenv("TRANSCODE_FORMATS")),
+		FFmpegBinary:            GetEnvWithDefault("FFMPEG_BINARY", "ffmpeg"),
+		TranscodeTimeout:        getEnvAsDuration("TRANSCODE_TIMEOUT", 2*time.Minute),
+	}
+	// DEBUG=true keeps enabling debug logs unless LOG_LEVEL says otherwise
+	defaultLogLevel := "info"
+	if config.Debug {
+		defaultLogLevel = "debug"
 	}
+	config.LogLevel = GetEnvWithDefault("LOG_LEVEL", defaultLogLevel)
+	config.LogFormat = GetEnvWithDefault("LOG_FORMAT", "text")
+	config.PostgresMaxIdleConns = int(getEnvAsInt64("POSTGRES_MAX_IDLE_CONNS", int64(config.PostgresMaxConns)))
+	config.SQLitePath = GetEnvWithDefault("SQLITE_PATH", filepath.Join(config.StoragePath, "messages.db"))
+	config.DeadLetterPath = GetEnvWithDefault("DEADLETTER_PATH", filepath.Join(config.StoragePath, "deadletter"))
+	config.S3Endpoint = GetEnvWithDefault("S3_ENDPOINT", fmt.Sprintf("https://s3.%s.amazonaws.com", config.S3Region))
 
 	if config.TelegramToken == "" {
 		return nil, fmt.Errorf("TELEGRAM_BOT_TOKEN is required")
 	}
 
+	switch config.UpdateMode {
+	case UpdateModePolling:
+		if config.APITimeout <= 60*time.Second {
+			return nil, fmt.Errorf("TELEGRAM_API_TIMEOUT must be longer than the 60 second long poll")
+		}
+	case UpdateModeWebhook:
+		if config.WebhookURL == "" {
+			return nil, fmt.Errorf("WEBHOOK_URL is required in webhook mode")
+		}
+		if !strings.HasPrefix(config.WebhookPath, "/") {
+			return nil, fmt.Errorf("WEBHOOK_PATH must start with \"/\", got %q", config.WebhookPath)
+		}
+		if (config.WebhookCertFile == "") != (config.WebhookKeyFile == "") {
+			return nil, fmt.Errorf("WEBHOOK_TLS_CERT and WEBHOOK_TLS_KEY must be set together")
+		}
+		if config.WebhookUploadCert && config.WebhookCertFile == "" {
+			return nil, fmt.Errorf("WEBHOOK_UPLOAD_CERT requires WEBHOOK_TLS_CERT")
+		}
+	default:
+		return nil, fmt.Errorf("invalid UPDATE_MODE %q: must be %q or %q", config.UpdateMode, UpdateModePolling, UpdateModeWebhook)
+	}
+
+	if config.WorkerCount < 1 {
+		return nil, fmt.Errorf("WORKER_COUNT must be at least 1")
+	}
+	if config.WorkerQueueSize < 0 {
+		return nil, fmt.Errorf("WORKER_QUEUE_SIZE must not be negative")
+	}
+
+	adminUserIDs, err := parseIDs(os.Getenv("ADMIN_USER_IDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ADMIN_USER_IDS: %w", err)
+	}
+	config.AdminUserIDs = adminUserIDs
+
+	if config.RetryAttempts < 1 {
+		return nil, fmt.Errorf("RETRY_ATTEMPTS must be at least 1")
+	}
+
+	if config.APIAddr != "" && len(config.APIToken) < 16 {
+		return nil, fmt.Errorf("API_TOKEN of at least 16 characters is required when API_ADDR is set")
+	}
+	if config.WebUIAddr != "" && len(config.WebUIPassword) < 8 {
+		return nil, fmt.Errorf("WEBUI_PASSWORD of at least 8 characters is required when WEBUI_ADDR is set")
+	}
+
+	switch config.StorageBackend {
+	case StorageBackendLocal, StorageBackendSQLite:
+	case StorageBackendPostgres:
+		if config.PostgresDSN == "" {
+			return nil, fmt.Errorf("POSTGRES_DSN is required when STORAGE_BACKEND is %q", StorageBackendPostgres)
+		}
+		if config.PostgresMaxConns < 1 {
+			return nil, fmt.Errorf("POSTGRES_MAX_CONNS must be at least 1")
+		}
+	default:
+		return nil, fmt.Errorf("invalid STORAGE_BACKEND %q: must be %q, %q or %q", config.StorageBackend,
+			StorageBackendLocal, StorageBackendSQLite, StorageBackendPostgres)
+	}
+
+	switch config.MediaBackend {
+	case MediaBackendFile:
+	case MediaBackendS3:
+		sqlite := config.StorageBackend == StorageBackendSQLite && !config.SQLiteStoreMediaDB
+		if !sqlite && config.StorageBackend != StorageBackendPostgres {
+			return nil, fmt.Errorf("MEDIA_BACKEND %q requires STORAGE_BACKEND %q without SQLITE_STORE_MEDIA_IN_DB, or %q",
+				MediaBackendS3, StorageBackendSQLite, StorageBackendPostgres)
+		}
+		if config.S3Bucket == "" || config.S3AccessKeyID == "" || config.S3SecretAccessKey == "" {
+			return nil, fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required when MEDIA_BACKEND is %q", MediaBackendS3)
+		}
+	default:
+		return nil, fmt.Errorf("invalid MEDIA_BACKEND %q: must be %q or %q", config.MediaBackend, MediaBackendFile, MediaBackendS3)
+	}
+
+	switch config.Transcriber {
+	case "":
+	case TranscriberWhisper:
+		if config.WhisperModel == "" {
+			return nil, fmt.Errorf("WHISPER_MODEL is required when TRANSCRIBER is %q", TranscriberWhisper)
+		}
+	default:
+		return nil, fmt.Errorf("invalid TRANSCRIBER %q: must be empty or %q", config.Transcriber, TranscriberWhisper)
+	}
+
 	return config, nil
 }
 
-func getEnvWithDefault(key, defaultValue string) string {
+// GetEnvWithDefault returns the environment variable key, or defaultValue if it is unset or empty
+func GetEnvWithDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
@@ -50,3 +310,56 @@ func getEnvAsInt64(key string, defaultValue int64) int64 {
 	}
 	return defaultValue
 }
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
+
+// parseList parses a comma separated list, lowercasing entries and dropping empty ones
+func parseList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// parseIDs parses a comma separated list of Telegram IDs
+func parseIDs(value string) ([]int64, error) {
+	var ids []int64
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(entry, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a user ID", entry)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseFileTypes parses a comma separated list of MIME types ("audio/ogg", "image/*")
+// and file extensions ("ogg", ".mp3"), normalizing extensions to a leading dot
+func parseFileTypes(value string) []string {
+	var types []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") && !strings.HasPrefix(entry, ".") {
+			entry = "." + entry
+		}
+		types = append(types, entry)
+	}
+	return types
+}
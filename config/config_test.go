@@ -0,0 +1,43 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigWebhookPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"", "/webhook", false},
+		{"/telegram/updates", "/telegram/updates", false},
+		{"/", "/", false},
+		{"webhook", "", true},
+		{"https://example.com/webhook", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			t.Setenv("TELEGRAM_BOT_TOKEN", "token")
+			t.Setenv("UPDATE_MODE", UpdateModeWebhook)
+			t.Setenv("WEBHOOK_URL", "https://example.com/webhook")
+			t.Setenv("WEBHOOK_PATH", tt.path)
+
+			config, err := LoadConfig()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "WEBHOOK_PATH") {
+					t.Errorf("LoadConfig = %v, want a WEBHOOK_PATH error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.WebhookPath != tt.want {
+				t.Errorf("WebhookPath = %q, want %q", config.WebhookPath, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package deadletter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/logger"
+	"telegram-message-receiver/metrics"
+)
+
+// scanInterval is how often the reprocessor looks for entries that are due for a retry
+const scanInterval = time.Minute
+
+// HandlerFunc processes a single update, as for the dispatcher, but reports failure
+type HandlerFunc func(ctx context.Context, update tgbotapi.Update) error
+
+// Reprocessor retries dead-lettered updates in the background once their next attempt is due.
+// Entries that succeed are removed; entries that failed maxAttempts times are left for manual
+// replay or discard.
+type Reprocessor struct {
+	store       *Store
+	handle      HandlerFunc
+	maxAttempts int
+	logger      *logger.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewReprocessor(store *Store, handle HandlerFunc, maxAttempts int, logger *logger.Logger) *Reprocessor {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Reprocessor{
+		store:       store,
+		handle:      handle,
+		maxAttempts: maxAttempts,
+		logger:      logger,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Start launches the background loop
+func (r *Reprocessor) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(scanInterval)
+		defer ticker.Stop()
+
+		for {
+			r.RetryDue(r.ctx)
+
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop cancels the retry in progress, if any, and waits for the loop to exit
+func (r *Reprocessor) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// RetryDue retries every entry whose next attempt is due
+func (r *Reprocessor) RetryDue(ctx context.Context) {
+	entries, err := r.store.List()
+	if err != nil {
+		r.logger.Error("Error listing dead letters", "error", err)
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		if entry.Attempts >= r.maxAttempts || entry.NextAttempt.After(now) {
+			continue
+		}
+		r.retry(ctx, entry)
+	}
+}
+
+func (r *Reprocessor) retry(ctx context.Context, entry Entry) {
+	log := r.logger.With("update_id", entry.UpdateID, "attempt", entry.Attempts+1)
+
+	update, err := entry.DecodeUpdate()
+	if err != nil {
+		log.Error("Error decoding dead letter", "error", err)
+		return
+	}
+
+	err = r.handle(ctx, update)
+	if ctx.Err() != nil {
+		// Interrupted by shutdown, which says nothing about the update itself
+		return
+	}
+	if err != nil {
+		log.Warn("Dead-lettered update failed again", "error", err)
+		if err := r.store.Add(update, err); err != nil {
+			log.Error("Error updating dead letter", "error", err)
+		}
+		return
+	}
+
+	if err := r.store.Remove(entry.UpdateID); err != nil {
+		log.Error("Error removing dead letter", "error", err)
+		return
+	}
+	metrics.DeadLettersRecovered.Inc()
+	log.Info("Dead-lettered update processed")
+}
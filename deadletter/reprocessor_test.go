@@ -0,0 +1,96 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/logger"
+)
+
+func TestRetryDue(t *testing.T) {
+	log, err := logger.NewLoggerWithOutput(io.Discard, slog.LevelError.String(), "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		retryDelay time.Duration
+		failures   int
+		handleErr  error
+		retried    bool
+		// attempts is the entry's attempt count afterwards, or 0 if it was removed
+		attempts int
+	}{
+		{"due and recovers", 0, 1, nil, true, 0},
+		{"due and fails again", 0, 1, errors.New("still down"), true, 2},
+		{"not due yet", time.Hour, 1, nil, false, 1},
+		{"out of attempts", 0, 3, nil, false, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewStore(t.TempDir(), tt.retryDelay)
+			for i := 0; i < tt.failures; i++ {
+				if err := store.Add(message(5, "hello"), errors.New("down")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			retried := false
+			r := NewReprocessor(store, func(ctx context.Context, update tgbotapi.Update) error {
+				retried = true
+				if update.UpdateID != 5 || update.Message.Text != "hello" {
+					t.Errorf("retried %+v, want the dead-lettered update", update)
+				}
+				return tt.handleErr
+			}, 3, log)
+			r.RetryDue(context.Background())
+
+			if retried != tt.retried {
+				t.Errorf("retried = %v, want %v", retried, tt.retried)
+			}
+			entry, err := store.Get(5)
+			switch {
+			case tt.attempts == 0 && !errors.Is(err, ErrNotFound):
+				t.Errorf("entry not removed after recovering: %+v, %v", entry, err)
+			case tt.attempts != 0 && err != nil:
+				t.Fatal(err)
+			case tt.attempts != 0 && entry.Attempts != tt.attempts:
+				t.Errorf("%d attempts recorded, want %d", entry.Attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryDueKeepsEntryWhenInterrupted(t *testing.T) {
+	log, err := logger.NewLoggerWithOutput(io.Discard, slog.LevelError.String(), "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(t.TempDir(), 0)
+	if err := store.Add(message(5, "hello"), errors.New("down")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewReprocessor(store, func(ctx context.Context, update tgbotapi.Update) error {
+		cancel()
+		return ctx.Err()
+	}, 3, log)
+	r.RetryDue(ctx)
+
+	entry, err := store.Get(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Shutdown isn't counted as a failed attempt
+	if entry.Attempts != 1 {
+		t.Errorf("%d attempts recorded, want 1", entry.Attempts)
+	}
+}
@@ -0,0 +1,205 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/metrics"
+)
+
+// ErrNotFound is returned for an update ID that has no dead-letter entry
+var ErrNotFound = errors.New("dead-letter entry not found")
+
+// Entry is an update that failed to process, together with why and when
+type Entry struct {
+	UpdateID    int             `json:"update_id"`
+	Update      json.RawMessage `json:"update"`
+	Error       string          `json:"error"`
+	Attempts    int             `json:"attempts"`
+	FirstFailed time.Time       `json:"first_failed"`
+	LastFailed  time.Time       `json:"last_failed"`
+	NextAttempt time.Time       `json:"next_attempt"`
+}
+
+// DecodeUpdate returns the update as received from Telegram
+func (e Entry) DecodeUpdate() (tgbotapi.Update, error) {
+	var update tgbotapi.Update
+	if err := json.Unmarshal(e.Update, &update); err != nil {
+		return update, fmt.Errorf("failed to decode update %d: %w", e.UpdateID, err)
+	}
+	return update, nil
+}
+
+// Store keeps dead-lettered updates as one JSON file per update under dir. It is safe for
+// concurrent use within a process.
+type Store struct {
+	dir string
+	mu  sync.Mutex
+
+	// retryDelay is the delay before the first automatic retry; it doubles after each failure
+	retryDelay time.Duration
+}
+
+// maxRetryDelay caps the growing delay between automatic retries
+const maxRetryDelay = 24 * time.Hour
+
+func NewStore(dir string, retryDelay time.Duration) *Store {
+	return &Store{dir: dir, retryDelay: retryDelay}
+}
+
+// Add records a failed attempt at processing update. The first failure creates the entry,
+// later ones update its error and schedule the next retry further out.
+func (s *Store) Add(update tgbotapi.Update, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entry, err := s.get(update.UpdateID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		raw, err := json.Marshal(update)
+		if err != nil {
+			return fmt.Errorf("failed to encode update: %w", err)
+		}
+		entry = Entry{UpdateID: update.UpdateID, Update: raw, FirstFailed: now}
+		metrics.DeadLettered.Inc()
+	case err != nil:
+		return err
+	}
+
+	entry.Error = cause.Error()
+	entry.Attempts++
+	entry.LastFailed = now
+	entry.NextAttempt = now.Add(s.backoff(entry.Attempts))
+
+	return s.write(entry)
+}
+
+// Get returns the entry for updateID, or ErrNotFound
+func (s *Store) Get(updateID int) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.get(updateID)
+}
+
+// List returns every entry ordered by update ID
+func (s *Store) List() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+
+	var entries []Entry
+	for _, file := range files {
+		id, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		entry, err := s.get(id)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].UpdateID < entries[j].UpdateID })
+	return entries, nil
+}
+
+// Remove deletes the entry for updateID, or returns ErrNotFound
+func (s *Store) Remove(updateID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(s.path(updateID))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove dead letter %d: %w", updateID, err)
+	}
+	return nil
+}
+
+func (s *Store) get(updateID int) (Entry, error) {
+	var entry Entry
+
+	data, err := os.ReadFile(s.path(updateID))
+	if errors.Is(err, os.ErrNotExist) {
+		return entry, ErrNotFound
+	}
+	if err != nil {
+		return entry, fmt.Errorf("failed to read dead letter %d: %w", updateID, err)
+	}
+
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, fmt.Errorf("failed to decode dead letter %d: %w", updateID, err)
+	}
+	return entry, nil
+}
+
+// write replaces the entry's file atomically so a crash never leaves half an entry behind
+func (s *Store) write(entry Entry) error {
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode dead letter: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync dead letter: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close dead letter: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path(entry.UpdateID)); err != nil {
+		return fmt.Errorf("failed to save dead letter: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) path(updateID int) string {
+	return filepath.Join(s.dir, strconv.Itoa(updateID)+".json")
+}
+
+func (s *Store) backoff(attempts int) time.Duration {
+	delay := s.retryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
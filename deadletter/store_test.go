@@ -0,0 +1,98 @@
+package deadletter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func message(updateID int, text string) tgbotapi.Update {
+	return tgbotapi.Update{
+		UpdateID: updateID,
+		Message:  &tgbotapi.Message{MessageID: updateID, Chat: &tgbotapi.Chat{ID: 1}, Text: text},
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := NewStore(t.TempDir(), time.Minute)
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{10, 512 * time.Minute},
+		{11, 1024 * time.Minute},
+		{12, maxRetryDelay},
+		{1000, maxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		if got := s.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestStoreAddGetRemove(t *testing.T) {
+	s := NewStore(t.TempDir(), time.Minute)
+
+	if entries, err := s.List(); err != nil || len(entries) != 0 {
+		t.Fatalf("List on an empty store = %v, %v", entries, err)
+	}
+
+	before := time.Now()
+	if err := s.Add(message(7, "hello"), errors.New("first")); err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.Get(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(message(7, "hello"), errors.New("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(message(3, "earlier"), errors.New("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := s.Get(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Attempts != 2 || entry.Error != "second" {
+		t.Errorf("after two failures: attempts %d, error %q", entry.Attempts, entry.Error)
+	}
+	if !entry.FirstFailed.Equal(first.FirstFailed) {
+		t.Errorf("first failure moved from %v to %v", first.FirstFailed, entry.FirstFailed)
+	}
+	if entry.NextAttempt.Before(before.Add(2 * time.Minute)) {
+		t.Errorf("next attempt %v is sooner than the doubled delay", entry.NextAttempt)
+	}
+	update, err := entry.DecodeUpdate()
+	if err != nil || update.Message.Text != "hello" {
+		t.Errorf("decoded update %+v, %v", update.Message, err)
+	}
+
+	entries, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].UpdateID != 3 || entries[1].UpdateID != 7 {
+		t.Errorf("List returned %v, want updates 3 and 7 in order", entries)
+	}
+
+	if err := s.Remove(7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(7); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Remove returned %v, want ErrNotFound", err)
+	}
+	if err := s.Remove(7); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Remove returned %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,148 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// HandlerFunc processes a single update. The context is cancelled when the dispatcher
+// is stopped and its deadline passes before the update has been handled.
+type HandlerFunc func(ctx context.Context, update tgbotapi.Update)
+
+// Dispatcher processes updates on a fixed pool of workers. Every chat is pinned to one
+// worker, so updates from different chats run concurrently while updates from the same
+// chat are handled in the order they were received.
+type Dispatcher struct {
+	queues []chan task
+	handle HandlerFunc
+	wg     sync.WaitGroup
+
+	// ctx is passed to every handler call and cancelled to abort in-flight work on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// task is a queued update, handled by run if it is set and by the dispatcher's handler otherwise
+type task struct {
+	update tgbotapi.Update
+	run    func(ctx context.Context)
+}
+
+// NewDispatcher creates a dispatcher with the given number of workers, each with a queue
+// holding up to queueSize pending updates
+func NewDispatcher(workers, queueSize int, handle HandlerFunc) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	queues := make([]chan task, workers)
+	for i := range queues {
+		queues[i] = make(chan task, queueSize)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Dispatcher{
+		queues: queues,
+		handle: handle,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start launches the workers
+func (d *Dispatcher) Start() {
+	for _, queue := range d.queues {
+		d.wg.Add(1)
+		go d.work(queue)
+	}
+}
+
+// Dispatch queues an update for its chat's worker. It blocks while that worker's queue is
+// full, which in turn slows down the receiver instead of buffering without bound, and
+// returns an error if ctx is done before the update could be queued.
+func (d *Dispatcher) Dispatch(ctx context.Context, update tgbotapi.Update) error {
+	return d.enqueue(ctx, task{update: update})
+}
+
+// Run queues update like Dispatch, but has handle process it instead of the dispatcher's
+// handler and waits for its result. The update is handled on its chat's worker, so it never
+// runs concurrently with other updates from the same chat. If ctx is done before handle
+// returns, Run returns ctx's error and the update is still handled later.
+func (d *Dispatcher) Run(ctx context.Context, update tgbotapi.Update, handle func(context.Context, tgbotapi.Update) error) error {
+	result := make(chan error, 1)
+	err := d.enqueue(ctx, task{update: update, run: func(ctx context.Context) {
+		result <- handle(ctx, update)
+	}})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) enqueue(ctx context.Context, t task) error {
+	select {
+	case d.queues[d.workerFor(t.update)] <- t:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop closes the queues and waits until every queued update has been handled. If ctx is
+// done first, the context of the handlers is cancelled, so the updates still in flight or
+// queued fail fast, and an error is returned once the workers have exited. Either way no
+// handler is running when Stop returns. Dispatch must not be called after Stop.
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return fmt.Errorf("updates interrupted: %w", ctx.Err())
+	}
+}
+
+func (d *Dispatcher) work(queue <-chan task) {
+	defer d.wg.Done()
+	for t := range queue {
+		if t.run != nil {
+			t.run(d.ctx)
+		} else {
+			d.handle(d.ctx, t.update)
+		}
+	}
+}
+
+func (d *Dispatcher) workerFor(update tgbotapi.Update) int {
+	var chatID int64
+	if chat := update.FromChat(); chat != nil {
+		chatID = chat.ID
+	}
+	// Group chat IDs are negative, the conversion keeps the modulo non-negative
+	return int(uint64(chatID) % uint64(len(d.queues)))
+}
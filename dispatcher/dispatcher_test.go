@@ -0,0 +1,139 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func message(updateID int, chatID int64) tgbotapi.Update {
+	return tgbotapi.Update{
+		UpdateID: updateID,
+		Message:  &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: chatID}},
+	}
+}
+
+func TestStopWaitsForCancelledHandlers(t *testing.T) {
+	var running, interrupted atomic.Int32
+	d := NewDispatcher(2, 10, func(ctx context.Context, update tgbotapi.Update) {
+		running.Add(1)
+		defer running.Add(-1)
+
+		<-ctx.Done()
+		// Cleanup after cancellation, like a handler recording the failure
+		time.Sleep(20 * time.Millisecond)
+		interrupted.Add(1)
+	})
+	d.Start()
+
+	for i := 1; i <= 4; i++ {
+		if err := d.Dispatch(context.Background(), message(i, int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := d.Stop(ctx); err == nil {
+		t.Error("Stop succeeded although the handlers outlived its deadline")
+	}
+
+	if n := running.Load(); n != 0 {
+		t.Errorf("%d handlers still running after Stop", n)
+	}
+	// The queued updates are handed to their handlers too, with the cancelled context
+	if n := interrupted.Load(); n != 4 {
+		t.Errorf("%d updates interrupted, want 4", n)
+	}
+}
+
+func TestRunWaitsForEarlierUpdatesOfItsChat(t *testing.T) {
+	release := make(chan struct{})
+	var handled atomic.Int32
+	d := NewDispatcher(4, 10, func(ctx context.Context, update tgbotapi.Update) {
+		<-release
+		handled.Add(1)
+	})
+	d.Start()
+	defer d.Stop(context.Background())
+
+	if err := d.Dispatch(context.Background(), message(1, 42)); err != nil {
+		t.Fatal(err)
+	}
+
+	replayErr := errors.New("still failing")
+	result := make(chan error, 1)
+	go func() {
+		result <- d.Run(context.Background(), message(2, 42), func(ctx context.Context, update tgbotapi.Update) error {
+			if handled.Load() != 1 {
+				t.Error("replay ran before the earlier update of its chat was handled")
+			}
+			return replayErr
+		})
+	}()
+
+	select {
+	case <-result:
+		t.Fatal("Run returned while the chat's worker was busy")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-result; !errors.Is(err, replayErr) {
+		t.Errorf("Run returned %v, want the handler's error", err)
+	}
+}
+
+func TestDispatchKeepsPerChatOrder(t *testing.T) {
+	const chats, perChat = 5, 50
+
+	var mu sync.Mutex
+	seen := make(map[int64][]int)
+	var running, overlapped atomic.Int32
+	d := NewDispatcher(3, 4, func(ctx context.Context, update tgbotapi.Update) {
+		if running.Add(1) > 1 {
+			overlapped.Store(1)
+		}
+		time.Sleep(100 * time.Microsecond)
+		running.Add(-1)
+
+		mu.Lock()
+		defer mu.Unlock()
+		chatID := update.Message.Chat.ID
+		seen[chatID] = append(seen[chatID], update.UpdateID)
+	})
+	d.Start()
+
+	updateID := 0
+	for i := 0; i < perChat; i++ {
+		for chat := int64(1); chat <= chats; chat++ {
+			updateID++
+			if err := d.Dispatch(context.Background(), message(updateID, chat)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for chat := int64(1); chat <= chats; chat++ {
+		ids := seen[chat]
+		if len(ids) != perChat {
+			t.Errorf("chat %d: %d updates handled, want %d", chat, len(ids), perChat)
+		}
+		for i := 1; i < len(ids); i++ {
+			if ids[i] <= ids[i-1] {
+				t.Errorf("chat %d: update %d handled after %d", chat, ids[i], ids[i-1])
+			}
+		}
+	}
+	if overlapped.Load() == 0 {
+		t.Error("updates from different chats never ran concurrently")
+	}
+}
@@ -0,0 +1,51 @@
+package dispatcher
+
+import "sync"
+
+// OffsetTracker works out which update ID can safely be acknowledged while updates finish
+// out of order. It only commits an update ID once it and every update received before it
+// have been handled, so a restart never skips an update that was still in flight.
+type OffsetTracker struct {
+	mu      sync.Mutex
+	pending []int
+	done    map[int]bool
+	commit  func(updateID int) error
+}
+
+// NewOffsetTracker creates a tracker that calls commit with each new acknowledged update ID.
+// Calls to commit are serialized and always receive increasing IDs.
+func NewOffsetTracker(commit func(updateID int) error) *OffsetTracker {
+	return &OffsetTracker{
+		done:   make(map[int]bool),
+		commit: commit,
+	}
+}
+
+// Received registers an update before it is dispatched. Updates must be registered in the
+// order they were received.
+func (t *OffsetTracker) Received(updateID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending = append(t.pending, updateID)
+}
+
+// Done marks an update as handled and commits the new acknowledged ID if it moved forward
+func (t *OffsetTracker) Done(updateID int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.done[updateID] = true
+
+	committable, advanced := 0, false
+	for len(t.pending) > 0 && t.done[t.pending[0]] {
+		committable, advanced = t.pending[0], true
+		delete(t.done, committable)
+		t.pending = t.pending[1:]
+	}
+
+	if !advanced {
+		return nil
+	}
+	return t.commit(committable)
+}
@@ -0,0 +1,60 @@
+package dispatcher
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		received []int
+		done     []int
+		want     []int
+	}{
+		{"in order", []int{1, 2, 3}, []int{1, 2, 3}, []int{1, 2, 3}},
+		{"last first", []int{1, 2, 3}, []int{3, 2, 1}, []int{3}},
+		{"gap held back", []int{1, 2, 3}, []int{1, 3}, []int{1}},
+		{"gap filled", []int{1, 2, 3, 4}, []int{2, 4, 1, 3}, []int{2, 4}},
+		{"first never done", []int{1, 2, 3}, []int{2, 3}, nil},
+		{"non-contiguous IDs", []int{10, 15, 40}, []int{15, 10, 40}, []int{15, 40}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var committed []int
+			tracker := NewOffsetTracker(func(updateID int) error {
+				committed = append(committed, updateID)
+				return nil
+			})
+
+			for _, id := range tt.received {
+				tracker.Received(id)
+			}
+			for _, id := range tt.done {
+				if err := tracker.Done(id); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !reflect.DeepEqual(committed, tt.want) {
+				t.Errorf("committed %v, want %v", committed, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsetTrackerReturnsCommitError(t *testing.T) {
+	commitErr := errors.New("disk full")
+	tracker := NewOffsetTracker(func(updateID int) error { return commitErr })
+
+	tracker.Received(1)
+	tracker.Received(2)
+	if err := tracker.Done(2); err != nil {
+		t.Errorf("Done(2) returned %v before anything could be committed", err)
+	}
+	if err := tracker.Done(1); !errors.Is(err, commitErr) {
+		t.Errorf("Done(1) returned %v, want the commit error", err)
+	}
+}
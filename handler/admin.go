@@ -0,0 +1,346 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/storage"
+)
+
+const (
+	// defaultLastMessages and maxLastMessages bound the count argument of /lastmessages
+	defaultLastMessages = 10
+	maxLastMessages     = 100
+
+	// broadcastInterval spaces out broadcast messages to stay under Telegram's limit of about
+	// 30 messages per second
+	broadcastInterval = 50 * time.Millisecond
+)
+
+// registerAdminCommands adds the commands reserved for the users in ADMIN_USER_IDS
+func (h *MessageHandler) registerAdminCommands() {
+	for _, command := range []Command{
+		{Name: "stats", Description: "Numbers of chats, contacts and messages", Handler: h.adminCommand(h.statsCommand)},
+		{Name: "users", Description: "Every chat with its phone number", Handler: h.adminCommand(h.usersCommand)},
+		{Name: "lastmessages", Args: "<chat> [count]", Description: "Latest messages of a chat", Handler: h.adminCommand(h.lastMessagesCommand)},
+		{Name: "export", Args: "<chat>", Description: "History of a chat as a JSON file", Handler: h.adminCommand(h.exportCommand)},
+		{Name: "broadcast", Args: "<text>", Description: "Send a message to every chat", Handler: h.adminCommand(h.broadcastCommand)},
+		{Name: "block", Args: "<chat>", Description: "Drop the messages of a chat", Handler: h.adminCommand(h.blockCommand)},
+		{Name: "unblock", Args: "<chat>", Description: "Accept the messages of a chat again", Handler: h.adminCommand(h.unblockCommand)},
+	} {
+		command.Permission = PermissionAdmin
+		h.RegisterCommand(command)
+	}
+}
+
+// usageError is a mistake in an admin command, reported back to the admin as is
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+func (h *MessageHandler) isAdmin(userID int64) bool {
+	for _, id := range h.config.AdminUserIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// adminCommand adapts an admin command to a CommandFunc. Failures are reported to the admin,
+// and all but usage mistakes are also returned so the update is dead-lettered; runCommand
+// recorded the command before it ran, so a retry won't run something like /broadcast again.
+func (h *MessageHandler) adminCommand(run func(ctx context.Context, chatID int64, args string) error) CommandFunc {
+	return func(ctx context.Context, message *tgbotapi.Message, args string) error {
+		err := run(ctx, message.Chat.ID, args)
+		if err == nil {
+			return nil
+		}
+
+		text := err.Error()
+		_, usage := err.(usageError)
+		if !usage {
+			h.log(ctx).Error("Admin command failed", "command", message.Command(), "error", err)
+			text = "/" + message.Command() + " failed: " + text
+		}
+		if err := h.send(ctx, tgbotapi.NewMessage(message.Chat.ID, text)); err != nil {
+			h.log(ctx).Error("Failed to report admin command result", "error", err)
+		}
+		if usage {
+			return nil
+		}
+		return fmt.Errorf("/%s failed: %w", message.Command(), err)
+	}
+}
+
+func (h *MessageHandler) statsCommand(ctx context.Context, chatID int64, args string) error {
+	chats, err := h.storage.ListChats(ctx)
+	if err != nil {
+		return err
+	}
+	counts, err := h.storage.CountMessages(ctx)
+	if err != nil {
+		return err
+	}
+
+	var contacts, blocked, total int
+	for _, chat := range chats {
+		if chat.PhoneNumber != "" {
+			contacts++
+		}
+		if chat.Blocked {
+			blocked++
+		}
+	}
+	kinds := make([]storage.MessageKind, 0, len(counts))
+	for kind, count := range counts {
+		kinds = append(kinds, kind)
+		total += count
+	}
+	sort.Slice(kinds, func(i, j int) bool { return counts[kinds[i]] > counts[kinds[j]] })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Chats: %d (%d blocked)\n", len(chats), blocked)
+	fmt.Fprintf(&b, "Shared contacts: %d\n", contacts)
+	fmt.Fprintf(&b, "Messages received: %d\n", total)
+	for _, kind := range kinds {
+		fmt.Fprintf(&b, "  %s: %d\n", kind, counts[kind])
+	}
+	return h.sendResult(ctx, chatID, "stats.txt", b.String())
+}
+
+func (h *MessageHandler) usersCommand(ctx context.Context, chatID int64, args string) error {
+	chats, err := h.storage.ListChats(ctx)
+	if err != nil {
+		return err
+	}
+	if len(chats) == 0 {
+		return h.sendResult(ctx, chatID, "users.txt", "No users yet.")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d users, most recently seen first:\n", len(chats))
+	for _, chat := range chats {
+		fmt.Fprintf(&b, "\n%s (%d)", chatName(chat), chat.ChatID)
+		if chat.PhoneNumber != "" {
+			fmt.Fprintf(&b, " %s", chat.PhoneNumber)
+		}
+		fmt.Fprintf(&b, ", last seen %s", formatTime(chat.LastSeen))
+		if chat.Blocked {
+			b.WriteString(", blocked")
+		}
+	}
+	return h.sendResult(ctx, chatID, "users.txt", b.String())
+}
+
+// lastMessagesCommand shows the latest messages of a chat: /lastmessages <chat> [count]
+func (h *MessageHandler) lastMessagesCommand(ctx context.Context, chatID int64, args string) error {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		return usageError("Usage: /lastmessages <chat ID or @username> [count]")
+	}
+	chat, err := h.resolveChat(ctx, fields[0])
+	if err != nil {
+		return err
+	}
+	count := defaultLastMessages
+	if len(fields) == 2 {
+		if count, err = strconv.Atoi(fields[1]); err != nil || count < 1 || count > maxLastMessages {
+			return usageError(fmt.Sprintf("The count must be between 1 and %d.", maxLastMessages))
+		}
+	}
+
+	messages, err := h.storage.ListMessages(ctx, storage.MessageFilter{ChatID: chat.ChatID, Limit: count, NewestFirst: true})
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return h.sendResult(ctx, chatID, "", fmt.Sprintf("No messages from %s.", chatName(*chat)))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Last %d messages of %s (%d):\n", len(messages), chatName(*chat), chat.ChatID)
+	for i := len(messages) - 1; i >= 0; i-- {
+		b.WriteString("\n" + formatMessage(messages[i]))
+	}
+	return h.sendResult(ctx, chatID, fmt.Sprintf("messages_%d.txt", chat.ChatID), b.String())
+}
+
+// chatExport is the file uploaded by /export
+type chatExport struct {
+	Chat     storage.Chat      `json:"chat"`
+	Messages []storage.Message `json:"messages"`
+}
+
+// exportCommand uploads the whole history of a chat as JSON: /export <chat>
+func (h *MessageHandler) exportCommand(ctx context.Context, chatID int64, args string) error {
+	if args == "" || strings.ContainsAny(args, " \n") {
+		return usageError("Usage: /export <chat ID or @username>")
+	}
+	chat, err := h.resolveChat(ctx, args)
+	if err != nil {
+		return err
+	}
+
+	// Read in one call: the local backend reads every file of the chat for each page it returns
+	messages, err := h.storage.ListMessages(ctx, storage.MessageFilter{ChatID: chat.ChatID, Limit: math.MaxInt})
+	if err != nil {
+		return err
+	}
+	export := chatExport{Chat: *chat, Messages: messages}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode export: %w", err)
+	}
+	return h.sendFile(ctx, chatID, fmt.Sprintf("chat_%d.json", chat.ChatID), data)
+}
+
+// broadcastCommand sends a message to every chat that isn't blocked: /broadcast <text>. Each
+// message is stored as a reply in its chat's history.
+func (h *MessageHandler) broadcastCommand(ctx context.Context, chatID int64, args string) error {
+	if args == "" {
+		return usageError("Usage: /broadcast <text>")
+	}
+	if utf8.RuneCountInString(args) > maxMessageLength {
+		return usageError(fmt.Sprintf("The text must not be longer than %d characters.", maxMessageLength))
+	}
+	chats, err := h.storage.ListChats(ctx)
+	if err != nil {
+		return err
+	}
+
+	var sent, recipients int
+	var failures []string
+	for _, chat := range chats {
+		if chat.Blocked {
+			continue
+		}
+		if recipients > 0 {
+			select {
+			case <-time.After(broadcastInterval):
+			case <-ctx.Done():
+				return fmt.Errorf("interrupted after sending to %d chats: %w", sent, ctx.Err())
+			}
+		}
+		recipients++
+
+		if _, err := h.deliverReply(ctx, chat, args, 0); err != nil {
+			h.log(ctx).Warn("Broadcast not delivered", "recipient", chat.ChatID, "error", err)
+			failures = append(failures, fmt.Sprintf("%s (%d): %v", chatName(chat), chat.ChatID, err))
+			continue
+		}
+		sent++
+	}
+
+	text := fmt.Sprintf("Broadcast sent to %d of %d chats.", sent, recipients)
+	if len(failures) > 0 {
+		text += "\n\nFailed:\n" + strings.Join(failures, "\n")
+	}
+	return h.sendResult(ctx, chatID, "broadcast.txt", text)
+}
+
+// blockCommand stops storing and answering messages from a chat: /block <chat>
+func (h *MessageHandler) blockCommand(ctx context.Context, chatID int64, args string) error {
+	return h.setBlocked(ctx, chatID, "block", args, true)
+}
+
+func (h *MessageHandler) unblockCommand(ctx context.Context, chatID int64, args string) error {
+	return h.setBlocked(ctx, chatID, "unblock", args, false)
+}
+
+func (h *MessageHandler) setBlocked(ctx context.Context, chatID int64, command, args string, blocked bool) error {
+	if args == "" || strings.ContainsAny(args, " \n") {
+		return usageError(fmt.Sprintf("Usage: /%s <chat ID or @username>", command))
+	}
+	chat, err := h.resolveChat(ctx, args)
+	if err != nil {
+		return err
+	}
+
+	if err := h.storage.SetBlocked(ctx, chat.ChatID, blocked); err != nil {
+		return err
+	}
+	h.log(ctx).Info("Chat blocked status changed", "blocked_chat_id", chat.ChatID, "blocked", blocked)
+	result := "Blocked"
+	if !blocked {
+		result = "Unblocked"
+	}
+	return h.sendResult(ctx, chatID, "", fmt.Sprintf("%s %s (%d).", result, chatName(*chat), chat.ChatID))
+}
+
+// resolveChat finds a chat the bot has heard from by its ID or @username
+func (h *MessageHandler) resolveChat(ctx context.Context, arg string) (*storage.Chat, error) {
+	chats, err := h.storage.ListChats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := func(chat storage.Chat) bool {
+		return strings.EqualFold(chat.Username, strings.TrimPrefix(arg, "@"))
+	}
+	if chatID, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		matches = func(chat storage.Chat) bool { return chat.ChatID == chatID }
+	}
+	for _, chat := range chats {
+		if matches(chat) {
+			return &chat, nil
+		}
+	}
+	return nil, usageError(fmt.Sprintf("No chat %s found.", arg))
+}
+
+// sendResult sends the result of an admin command as a message, or uploads it as a text file
+// named fileName if it is too long for one
+func (h *MessageHandler) sendResult(ctx context.Context, chatID int64, fileName, text string) error {
+	if utf8.RuneCountInString(text) <= maxMessageLength || fileName == "" {
+		return h.send(ctx, tgbotapi.NewMessage(chatID, text))
+	}
+	return h.sendFile(ctx, chatID, fileName, []byte(text))
+}
+
+func (h *MessageHandler) sendFile(ctx context.Context, chatID int64, fileName string, data []byte) error {
+	return h.send(ctx, tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: fileName, Bytes: data}))
+}
+
+// chatName is how admin command results refer to a chat
+func chatName(chat storage.Chat) string {
+	if chat.Username == "" || chat.Username == "anonymous" {
+		return "chat"
+	}
+	return "@" + chat.Username
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04 UTC")
+}
+
+// formatMessage renders a stored message as a line of /lastmessages
+func formatMessage(message storage.Message) string {
+	sender := chatName(storage.Chat{Username: message.Username})
+	if message.Outbound {
+		sender = "bot"
+	}
+
+	var content string
+	switch message.Kind {
+	case storage.KindText:
+		content = message.Text
+	case storage.KindVoice:
+		content = fmt.Sprintf("[voice %d:%02d]", message.Duration/60, message.Duration%60)
+		if message.Transcript != "" {
+			content += " " + message.Transcript
+		}
+	default:
+		content = fmt.Sprintf("[%s %s, %s]", message.Kind, message.FileName, formatSize(message.Size))
+	}
+	return fmt.Sprintf("%s %s: %s", formatTime(message.Timestamp), sender, content)
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"telegram-message-receiver/config"
+	"telegram-message-receiver/storage"
+)
+
+func TestBlockedChat(t *testing.T) {
+	ctx := context.Background()
+	telegram := &fakeTelegram{}
+	h, s := newTestHandler(t, telegram, &config.Config{AdminUserIDs: []int64{9}})
+	shareContact(t, s, 5)
+
+	handle := func(messageID int, chatID int64, text string) {
+		t.Helper()
+		if err := h.HandleMessage(ctx, textMessage(messageID, chatID, text)); err != nil {
+			t.Fatalf("%q from chat %d: %v", text, chatID, err)
+		}
+	}
+	// lastSent returns what was sent since the previous call
+	seen := 0
+	lastSent := func() []sentMessage {
+		sent := telegram.messages()[seen:]
+		seen += len(sent)
+		return sent
+	}
+	stored := func(messageID int) bool {
+		t.Helper()
+		stored, err := s.HasMessage(ctx, 5, messageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+
+	handle(1, 5, "hello")
+	if !stored(1) {
+		t.Fatal("message before blocking not stored")
+	}
+
+	handle(1, 9, "/block 5")
+	if blocked, err := s.IsBlocked(ctx, 5); err != nil || !blocked {
+		t.Fatalf("chat 5 blocked = %v, %v after /block", blocked, err)
+	}
+	if sent := lastSent(); len(sent) != 1 || sent[0].chatID != 9 || !strings.HasPrefix(sent[0].text, "Blocked") {
+		t.Errorf("/block answered %+v", sent)
+	}
+
+	// Messages and commands of a blocked chat are dropped without an answer
+	handle(2, 5, "dropped")
+	handle(3, 5, "/start")
+	if stored(2) || stored(3) {
+		t.Error("message from a blocked chat stored")
+	}
+	if sent := lastSent(); len(sent) != 0 {
+		t.Errorf("sent %+v to a blocked chat", sent)
+	}
+
+	// Admins can still run their commands from a blocked chat
+	if err := s.SetBlocked(ctx, 9, true); err != nil {
+		t.Fatal(err)
+	}
+	handle(2, 9, "/stats")
+	if sent := lastSent(); len(sent) != 1 || sent[0].chatID != 9 || !strings.Contains(sent[0].text, "1 blocked") {
+		t.Errorf("/stats from a blocked admin chat answered %+v", sent)
+	}
+	handle(3, 9, "/unblock 5")
+	if sent := lastSent(); len(sent) != 1 || !strings.HasPrefix(sent[0].text, "Unblocked") {
+		t.Errorf("/unblock answered %+v", sent)
+	}
+
+	handle(4, 5, "accepted again")
+	if !stored(4) {
+		t.Error("message after unblocking not stored")
+	}
+}
+
+// countingStorage counts ListMessages calls and fails ListChats once failChats is set
+type countingStorage struct {
+	storage.MessageStorage
+	failChats bool
+	lists     int
+}
+
+func (s *countingStorage) ListChats(ctx context.Context) ([]storage.Chat, error) {
+	if s.failChats {
+		return nil, errDiskFull
+	}
+	return s.MessageStorage.ListChats(ctx)
+}
+
+func (s *countingStorage) ListMessages(ctx context.Context, filter storage.MessageFilter) ([]storage.Message, error) {
+	s.lists++
+	return s.MessageStorage.ListMessages(ctx, filter)
+}
+
+func TestAdminCommandErrors(t *testing.T) {
+	ctx := context.Background()
+	telegram := &fakeTelegram{}
+	h, s := newTestHandler(t, telegram, &config.Config{AdminUserIDs: []int64{9}})
+	counting := &countingStorage{MessageStorage: s, failChats: true}
+	h.storage = counting
+
+	// A usage mistake is only reported
+	if err := h.HandleMessage(ctx, textMessage(1, 9, "/block")); err != nil {
+		t.Errorf("/block without a chat returned %v", err)
+	}
+	if sent := telegram.messages(); len(sent) != 1 || !strings.HasPrefix(sent[0].text, "Usage: /block") {
+		t.Errorf("/block without a chat answered %+v", sent)
+	}
+
+	// A storage failure is reported and returned, so the update is dead-lettered
+	if err := h.HandleMessage(ctx, textMessage(2, 9, "/users")); !errors.Is(err, errDiskFull) {
+		t.Errorf("/users returned %v, want the storage error", err)
+	}
+	if sent := telegram.messages(); len(sent) != 2 || !strings.HasPrefix(sent[1].text, "/users failed: disk full") {
+		t.Errorf("/users answered %+v", sent)
+	}
+
+	// The retry of the dead letter doesn't run the command again
+	counting.failChats = false
+	if err := h.HandleMessage(ctx, textMessage(2, 9, "/users")); err != nil {
+		t.Errorf("redelivered /users returned %v", err)
+	}
+	if sent := telegram.messages(); len(sent) != 2 {
+		t.Errorf("redelivered /users answered %+v", sent[2:])
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	ctx := context.Background()
+	telegram := &fakeTelegram{}
+	h, s := newTestHandler(t, telegram, &config.Config{AdminUserIDs: []int64{9}})
+	counting := &countingStorage{MessageStorage: s}
+	h.storage = counting
+
+	const count = 25
+	for i := 1; i <= count; i++ {
+		info := storage.MessageInfo{MessageID: i, ChatID: 5, UserID: 5, Username: "user", Timestamp: time.Unix(1700000000+int64(i), 0)}
+		if err := s.SaveTextMessage(ctx, storage.TextMessage{MessageInfo: info, Text: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := h.HandleMessage(ctx, textMessage(1, 9, "/export 5")); err != nil {
+		t.Fatal(err)
+	}
+	sent := telegram.messages()
+	if len(sent) != 1 || sent[0].document != "chat_5.json" {
+		t.Fatalf("/export sent %+v, want chat_5.json", sent)
+	}
+
+	var export chatExport
+	if err := json.Unmarshal([]byte(sent[0].text), &export); err != nil {
+		t.Fatal(err)
+	}
+	if export.Chat.ChatID != 5 || len(export.Messages) != count {
+		t.Errorf("exported chat %d with %d messages, want chat 5 with %d", export.Chat.ChatID, len(export.Messages), count)
+	}
+	for i, message := range export.Messages {
+		if message.MessageID != i+1 {
+			t.Errorf("message %d of the export is message %d", i, message.MessageID)
+			break
+		}
+	}
+	if counting.lists != 1 {
+		t.Errorf("/export listed messages %d times, want once", counting.lists)
+	}
+}
@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/metrics"
+	"telegram-message-receiver/storage"
+)
+
+// Permission is the level a user needs to run a command
+type Permission int
+
+const (
+	// PermissionPublic commands can be run by anyone, before sharing a contact
+	PermissionPublic Permission = iota
+	// PermissionUser commands can be run once the user has shared a contact
+	PermissionUser
+	// PermissionAdmin commands are reserved for the users in ADMIN_USER_IDS. They are handled
+	// before the blocked chat and contact checks, and are never stored.
+	PermissionAdmin
+)
+
+// CommandFunc handles a command; args is the text following it, trimmed
+type CommandFunc func(ctx context.Context, message *tgbotapi.Message, args string) error
+
+// Command is a bot command as registered with a CommandRouter
+type Command struct {
+	// Name is the command without its slash: 1 to 32 lowercase letters, digits and underscores
+	Name string
+	// Args describes the arguments in /help, e.g. "<chat> [count]"
+	Args        string
+	Description string
+	Permission  Permission
+	Handler     CommandFunc
+}
+
+// commandName is the syntax Telegram accepts for command names
+var commandName = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// CommandRouter maps command names to the commands registered for them
+type CommandRouter struct {
+	commands map[string]Command
+	// names keeps the registration order, which /help and the command menu follow
+	names []string
+}
+
+func NewCommandRouter() *CommandRouter {
+	return &CommandRouter{commands: make(map[string]Command)}
+}
+
+// Register adds a command. Like http.ServeMux, it panics on invalid or duplicate names.
+func (r *CommandRouter) Register(command Command) {
+	if !commandName.MatchString(command.Name) {
+		panic(fmt.Sprintf("handler: invalid command name %q", command.Name))
+	}
+	if _, ok := r.commands[command.Name]; ok {
+		panic(fmt.Sprintf("handler: command %q registered twice", command.Name))
+	}
+	if command.Description == "" || command.Handler == nil {
+		panic(fmt.Sprintf("handler: command %q needs a description and a handler", command.Name))
+	}
+
+	r.commands[command.Name] = command
+	r.names = append(r.names, command.Name)
+}
+
+// Lookup returns the command registered under name
+func (r *CommandRouter) Lookup(name string) (Command, bool) {
+	command, ok := r.commands[name]
+	return command, ok
+}
+
+// Commands returns the commands a user with permission can run, in registration order
+func (r *CommandRouter) Commands(permission Permission) []Command {
+	var commands []Command
+	for _, name := range r.names {
+		if command := r.commands[name]; command.Permission <= permission {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// Help lists the commands a user with permission can run, admin commands apart
+func (r *CommandRouter) Help(permission Permission) string {
+	var general, admin strings.Builder
+	for _, command := range r.Commands(permission) {
+		b := &general
+		if command.Permission == PermissionAdmin {
+			b = &admin
+		}
+		b.WriteString("/" + command.Name)
+		if command.Args != "" {
+			b.WriteString(" " + command.Args)
+		}
+		b.WriteString(" - " + command.Description + "\n")
+	}
+
+	help := "Commands:\n" + general.String()
+	if admin.Len() > 0 {
+		help += "\nAdmin commands:\n" + admin.String()
+	}
+	return help
+}
+
+// botCommands converts commands to the entries of the command menu
+func botCommands(commands []Command) []tgbotapi.BotCommand {
+	entries := make([]tgbotapi.BotCommand, len(commands))
+	for i, command := range commands {
+		entries[i] = tgbotapi.BotCommand{Command: command.Name, Description: command.Description}
+	}
+	return entries
+}
+
+// RegisterCommand adds a command to the ones the bot answers; see CommandRouter.Register. It
+// must be called before updates are handled.
+func (h *MessageHandler) RegisterCommand(command Command) {
+	h.commands.Register(command)
+}
+
+// PublishCommands sets the command menu Telegram shows users: the public and user commands
+// for everyone, and all commands in the private chats of the admins. Admins who never started
+// a chat with the bot are skipped.
+func (h *MessageHandler) PublishCommands(ctx context.Context) error {
+	everyone := tgbotapi.NewSetMyCommands(botCommands(h.commands.Commands(PermissionUser))...)
+	if err := h.request(ctx, "set commands", everyone); err != nil {
+		return fmt.Errorf("failed to set commands: %w", err)
+	}
+
+	admin := botCommands(h.commands.Commands(PermissionAdmin))
+	for _, userID := range h.config.AdminUserIDs {
+		if err := h.request(ctx, "set admin commands", tgbotapi.NewSetMyCommandsWithScope(tgbotapi.NewBotCommandScopeChat(userID), admin...)); err != nil {
+			h.log(ctx).Warn("Failed to set admin commands", "user_id", userID, "error", err)
+		}
+	}
+	return nil
+}
+
+// request makes a Telegram API call whose result isn't needed, retrying transient failures
+func (h *MessageHandler) request(ctx context.Context, what string, c tgbotapi.Chattable) error {
+	return h.retry(ctx, what, func() error {
+		_, err := h.bot.Request(c)
+		return err
+	})
+}
+
+// commandOf returns the name of the command a message starts with, or "" if it isn't a
+// command or is addressed to another bot, as in "/start@OtherBot"
+func (h *MessageHandler) commandOf(message *tgbotapi.Message) string {
+	if !message.IsCommand() {
+		return ""
+	}
+	if _, bot, ok := strings.Cut(message.CommandWithAt(), "@"); ok && !strings.EqualFold(bot, h.bot.Self.UserName) {
+		return ""
+	}
+	return strings.ToLower(message.Command())
+}
+
+// permitted reports whether the sender of message may run commands at permission. Whether
+// they shared a contact is up to where the command is routed.
+func (h *MessageHandler) permitted(message *tgbotapi.Message, permission Permission) bool {
+	return permission != PermissionAdmin || (message.From != nil && h.isAdmin(message.From.ID))
+}
+
+// runCommand records the command's message as handled, then runs it. Recording comes first so
+// an update redelivered after a crash can't run a command like /broadcast a second time.
+func (h *MessageHandler) runCommand(ctx context.Context, command Command, message *tgbotapi.Message) error {
+	err := h.storage.RecordMessage(ctx, message.Chat.ID, message.MessageID)
+	if errors.Is(err, storage.ErrDuplicateMessage) {
+		h.log(ctx).Debug("Skipping command already handled", "command", command.Name)
+		return nil
+	}
+	if err != nil {
+		h.log(ctx).Error("Error recording command", "error", err)
+		return err
+	}
+
+	metrics.CommandsHandled.WithLabelValues(command.Name).Inc()
+	h.log(ctx).Info("Running command", "command", command.Name)
+	return command.Handler(ctx, message, strings.TrimSpace(message.CommandArguments()))
+}
+
+func (h *MessageHandler) unknownCommand(ctx context.Context, chatID int64) error {
+	return h.send(ctx, tgbotapi.NewMessage(chatID, "Unknown command. Send /help to see what I can do."))
+}
+
+func (h *MessageHandler) helpCommand(ctx context.Context, message *tgbotapi.Message, args string) error {
+	permission := PermissionUser
+	if h.permitted(message, PermissionAdmin) {
+		permission = PermissionAdmin
+	}
+	return h.send(ctx, tgbotapi.NewMessage(message.Chat.ID, h.commands.Help(permission)))
+}
+
+func (h *MessageHandler) startCommand(ctx context.Context, message *tgbotapi.Message, args string) error {
+	if args != "" {
+		h.log(ctx).Debug("Start payload received", "payload", args)
+	}
+	return h.handleStartCommand(ctx, message.Chat.ID)
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestCommandOf(t *testing.T) {
+	tests := []struct {
+		text string
+		// offset is where the bot_command entity starts; -1 leaves it out
+		offset int
+		want   string
+	}{
+		{"/start", 0, "start"},
+		{"/start@test_bot", 0, "start"},
+		{"/start@Test_Bot", 0, "start"},
+		{"/start@OtherBot", 0, ""},
+		{"/Stats", 0, "stats"},
+		{"/lastmessages 5 10", 0, "lastmessages"},
+		{"/lastmessages@test_bot @user 10", 0, "lastmessages"},
+		{"/export@OtherBot 5", 0, ""},
+		{"hello", -1, ""},
+		{"/start", -1, ""},
+		{"see /start", 4, ""},
+	}
+
+	h, _ := newTestHandler(t, &fakeTelegram{}, nil)
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			message := textMessage(1, 5, tt.text)
+			message.Entities = nil
+			if tt.offset >= 0 {
+				command, _, _ := strings.Cut(tt.text[tt.offset:], " ")
+				message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: tt.offset, Length: len(command)}}
+			}
+
+			if got := h.commandOf(message); got != tt.want {
+				t.Errorf("commandOf(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func noopCommand(ctx context.Context, message *tgbotapi.Message, args string) error {
+	return nil
+}
+
+func TestRegisterPanics(t *testing.T) {
+	tests := []struct {
+		name    string
+		command Command
+	}{
+		{"empty name", Command{Name: "", Description: "d", Handler: noopCommand}},
+		{"uppercase", Command{Name: "Start", Description: "d", Handler: noopCommand}},
+		{"slash", Command{Name: "/start", Description: "d", Handler: noopCommand}},
+		{"space", Command{Name: "last messages", Description: "d", Handler: noopCommand}},
+		{"too long", Command{Name: strings.Repeat("a", 33), Description: "d", Handler: noopCommand}},
+		{"duplicate", Command{Name: "help", Description: "d", Handler: noopCommand}},
+		{"no description", Command{Name: "other", Handler: noopCommand}},
+		{"no handler", Command{Name: "other", Description: "d"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewCommandRouter()
+			router.Register(Command{Name: "help", Description: "d", Handler: noopCommand})
+
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%+v) didn't panic", tt.command)
+				}
+			}()
+			router.Register(tt.command)
+		})
+	}
+
+	// The longest valid name is accepted
+	NewCommandRouter().Register(Command{Name: strings.Repeat("a", 32), Description: "d", Handler: noopCommand})
+}
+
+func TestCommandsByPermission(t *testing.T) {
+	router := NewCommandRouter()
+	router.Register(Command{Name: "start", Description: "Start the bot", Permission: PermissionPublic, Handler: noopCommand})
+	router.Register(Command{Name: "stats", Description: "Numbers", Permission: PermissionAdmin, Handler: noopCommand})
+	router.Register(Command{Name: "profile", Description: "Your profile", Permission: PermissionUser, Handler: noopCommand})
+	router.Register(Command{Name: "block", Args: "<chat>", Description: "Drop a chat", Permission: PermissionAdmin, Handler: noopCommand})
+
+	tests := []struct {
+		permission Permission
+		commands   []string
+		help       string
+	}{
+		{PermissionPublic, []string{"start"},
+			"Commands:\n/start - Start the bot\n"},
+		{PermissionUser, []string{"start", "profile"},
+			"Commands:\n/start - Start the bot\n/profile - Your profile\n"},
+		{PermissionAdmin, []string{"start", "stats", "profile", "block"},
+			"Commands:\n/start - Start the bot\n/profile - Your profile\n\nAdmin commands:\n/stats - Numbers\n/block <chat> - Drop a chat\n"},
+	}
+
+	for _, tt := range tests {
+		var names []string
+		for _, command := range router.Commands(tt.permission) {
+			names = append(names, command.Name)
+		}
+		if !reflect.DeepEqual(names, tt.commands) {
+			t.Errorf("Commands(%d) = %v, want %v", tt.permission, names, tt.commands)
+		}
+		if got := router.Help(tt.permission); got != tt.help {
+			t.Errorf("Help(%d) = %q, want %q", tt.permission, got, tt.help)
+		}
+	}
+}
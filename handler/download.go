@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/metrics"
+	"telegram-message-receiver/retry"
+)
+
+// attachment describes a file attached to a message as reported by Telegram
+type attachment struct {
+	fileID       string
+	fileUniqueID string
+	fileName     string
+	mimeType     string
+	fileSize     int64
+}
+
+// FileRejectedError is returned when a file is refused because of its size or type
+type FileRejectedError struct {
+	Reason string
+}
+
+func (e *FileRejectedError) Error() string {
+	return "file rejected: " + e.Reason
+}
+
+// downloadFile fetches an attachment from Telegram. Failures, downloaded bytes and the
+// time until the returned body is closed are recorded in metrics.
+func (h *MessageHandler) downloadFile(ctx context.Context, att attachment) (io.ReadCloser, tgbotapi.File, error) {
+	start := time.Now()
+	body, file, err := h.fetchFile(ctx, att)
+	if err != nil {
+		metrics.DownloadFailures.WithLabelValues(downloadFailureReason(err)).Inc()
+		return nil, file, err
+	}
+	return &meteredReadCloser{rc: body, start: start}, file, nil
+}
+
+func (h *MessageHandler) fetchFile(ctx context.Context, att attachment) (io.ReadCloser, tgbotapi.File, error) {
+	// Refuse early using what the message already tells us, before asking Telegram for the file
+	if err := h.checkFileSize(att.fileSize); err != nil {
+		return nil, tgbotapi.File{}, err
+	}
+
+	var file tgbotapi.File
+	err := h.retry(ctx, "get file", func() error {
+		var err error
+		file, err = h.bot.GetFile(tgbotapi.FileConfig{FileID: att.fileID})
+		return err
+	})
+	if err != nil {
+		return nil, file, &telegramError{fmt.Errorf("failed to get file info: %w", err)}
+	}
+
+	if err := h.checkFileSize(int64(file.FileSize)); err != nil {
+		return nil, file, err
+	}
+
+	fileName := att.fileName
+	if fileName == "" {
+		fileName = file.FilePath
+	}
+	if !h.validateFileType(fileName, att.mimeType) {
+		return nil, file, &FileRejectedError{Reason: fmt.Sprintf("files of type %s are not accepted", describeFileType(fileName, att.mimeType))}
+	}
+
+	fileURL := fmt.Sprintf(h.config.BaseFileURL, h.bot.Token, file.FilePath)
+
+	var resp *http.Response
+	err = h.retry(ctx, "download file", func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+		if err != nil {
+			return retry.Permanent(fmt.Errorf("failed to create download request: %w", err))
+		}
+
+		r, err := h.httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to download file: %w", err)
+		}
+
+		if r.StatusCode != http.StatusOK {
+			r.Body.Close()
+			err := fmt.Errorf("failed to download file: status code %d", r.StatusCode)
+			if r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500 {
+				return err
+			}
+			return retry.Permanent(err)
+		}
+
+		resp = r
+		return nil
+	})
+	if err != nil {
+		return nil, file, err
+	}
+
+	if err := h.checkFileSize(resp.ContentLength); err != nil {
+		resp.Body.Close()
+		return nil, file, err
+	}
+
+	// Sizes reported by Telegram are advisory, so also cap what is actually streamed
+	return newLimitedReadCloser(resp.Body, h.config.MaxFileSize), file, nil
+}
+
+func (h *MessageHandler) checkFileSize(size int64) error {
+	if h.config.MaxFileSize > 0 && size > h.config.MaxFileSize {
+		return &FileRejectedError{Reason: fmt.Sprintf("the file is %s, the maximum allowed size is %s", formatSize(size), formatSize(h.config.MaxFileSize))}
+	}
+	return nil
+}
+
+// validateFileType checks the file extension and MIME type against config.AllowedFileTypes.
+// An empty list allows every type.
+func (h *MessageHandler) validateFileType(fileName, mimeType string) bool {
+	if len(h.config.AllowedFileTypes) == 0 {
+		return true
+	}
+
+	ext := strings.ToLower(filepath.Ext(fileName))
+	mimeType = strings.ToLower(mimeType)
+
+	for _, allowed := range h.config.AllowedFileTypes {
+		switch {
+		case strings.HasPrefix(allowed, "."):
+			if ext == allowed {
+				return true
+			}
+		case strings.HasSuffix(allowed, "/*"):
+			if mimeType != "" && strings.HasPrefix(mimeType, strings.TrimSuffix(allowed, "*")) {
+				return true
+			}
+		default:
+			if mimeType == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func describeFileType(fileName, mimeType string) string {
+	if ext := filepath.Ext(fileName); ext != "" {
+		return ext
+	}
+	if mimeType != "" {
+		return mimeType
+	}
+	return "unknown"
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// limitedReadCloser fails with a FileRejectedError once more than limit bytes have been read
+type limitedReadCloser struct {
+	rc        io.ReadCloser
+	limit     int64
+	remaining int64
+}
+
+func newLimitedReadCloser(rc io.ReadCloser, limit int64) io.ReadCloser {
+	if limit <= 0 {
+		return rc
+	}
+	return &limitedReadCloser{rc: rc, limit: limit, remaining: limit}
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	// Allow reading one byte past the limit so we can tell "exactly limit" from "too large"
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.rc.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, &FileRejectedError{Reason: fmt.Sprintf("the file exceeds the maximum allowed size of %s", formatSize(l.limit))}
+	}
+	return n, err
+}
+
+func (l *limitedReadCloser) Close() error {
+	return l.rc.Close()
+}
+
+// telegramError marks a failure of the Telegram Bot API, as opposed to the file download itself
+type telegramError struct {
+	err error
+}
+
+func (e *telegramError) Error() string { return e.err.Error() }
+func (e *telegramError) Unwrap() error { return e.err }
+
+func downloadFailureReason(err error) string {
+	var rejected *FileRejectedError
+	var telegram *telegramError
+	switch {
+	case errors.As(err, &rejected):
+		return metrics.DownloadRejected
+	case errors.As(err, &telegram):
+		return metrics.DownloadTelegram
+	default:
+		return metrics.DownloadHTTP
+	}
+}
+
+// meteredReadCloser counts the bytes read from a download and records its duration when closed
+type meteredReadCloser struct {
+	rc     io.ReadCloser
+	start  time.Time
+	failed bool
+}
+
+func (m *meteredReadCloser) Read(p []byte) (int, error) {
+	n, err := m.rc.Read(p)
+	metrics.DownloadBytes.Add(float64(n))
+	if err != nil && err != io.EOF && !m.failed {
+		m.failed = true
+		metrics.DownloadFailures.WithLabelValues(downloadFailureReason(err)).Inc()
+	}
+	return n, err
+}
+
+func (m *meteredReadCloser) Close() error {
+	metrics.DownloadDuration.Observe(time.Since(m.start).Seconds())
+	return m.rc.Close()
+}
@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/config"
+	"telegram-message-receiver/logger"
+)
+
+func TestLimitedReadCloser(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		limit    int64
+		rejected bool
+	}{
+		{"under the limit", 99, 100, false},
+		{"exactly the limit", 100, 100, false},
+		{"one byte over", 101, 100, true},
+		{"far over", 10000, 100, true},
+		{"empty", 0, 100, false},
+		{"no limit", 10000, 0, false},
+	}
+
+	for _, tt := range tests {
+		for _, oneByte := range []bool{false, true} {
+			name := tt.name
+			if oneByte {
+				name += " one byte at a time"
+			}
+			t.Run(name, func(t *testing.T) {
+				var reader io.Reader = strings.NewReader(strings.Repeat("x", tt.size))
+				if oneByte {
+					reader = iotest.OneByteReader(reader)
+				}
+
+				data, err := io.ReadAll(newLimitedReadCloser(io.NopCloser(reader), tt.limit))
+
+				var rejected *FileRejectedError
+				if got := errors.As(err, &rejected); got != tt.rejected {
+					t.Fatalf("rejected = %v (err %v), want %v", got, err, tt.rejected)
+				}
+				if !tt.rejected && len(data) != tt.size {
+					t.Errorf("read %d bytes, want %d", len(data), tt.size)
+				}
+				// Never more than one byte past the limit is read into memory
+				if tt.rejected && int64(len(data)) > tt.limit+1 {
+					t.Errorf("read %d bytes with a limit of %d", len(data), tt.limit)
+				}
+			})
+		}
+	}
+}
+
+func TestValidateFileType(t *testing.T) {
+	tests := []struct {
+		allowed  []string
+		fileName string
+		mimeType string
+		want     bool
+	}{
+		{nil, "virus.exe", "application/octet-stream", true},
+		{[]string{".pdf"}, "scan.PDF", "", true},
+		{[]string{".pdf"}, "scan.docx", "application/pdf", false},
+		{[]string{"image/*"}, "photo", "image/jpeg", true},
+		{[]string{"image/*"}, "photo.jpg", "", false},
+		{[]string{"audio/ogg"}, "voice", "Audio/OGG", true},
+		{[]string{"audio/ogg"}, "voice", "audio/mpeg", false},
+		{[]string{".pdf", "video/*"}, "clip.mp4", "video/mp4", true},
+	}
+
+	for _, tt := range tests {
+		h := &MessageHandler{config: &config.Config{AllowedFileTypes: tt.allowed}}
+		if got := h.validateFileType(tt.fileName, tt.mimeType); got != tt.want {
+			t.Errorf("validateFileType(%q, %q) with %v = %v, want %v", tt.fileName, tt.mimeType, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+// fakeFiles answers getMe and getFile like the Bot API and serves file content, reporting
+// sizes as configured
+type fakeFiles struct {
+	content string
+	// reportedSize is the file_size getFile returns
+	reportedSize int
+	// chunked sends the content without a Content-Length
+	chunked bool
+}
+
+func (f *fakeFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/file/") {
+		if !f.chunked {
+			w.Header().Set("Content-Length", strconv.Itoa(len(f.content)))
+		}
+		io.WriteString(w, f.content)
+		return
+	}
+
+	var result interface{} = true
+	switch path.Base(r.URL.Path) {
+	case "getMe":
+		result = tgbotapi.User{ID: 1, IsBot: true, UserName: "test_bot"}
+	case "getFile":
+		result = tgbotapi.File{FileID: r.FormValue("file_id"), FileSize: f.reportedSize, FilePath: "documents/file_1.pdf"}
+	}
+	raw, _ := json.Marshal(result)
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: true, Result: raw})
+}
+
+func TestFetchFileSizeLimits(t *testing.T) {
+	const limit = 1000
+
+	tests := []struct {
+		name string
+		// messageSize is the size the message reported
+		messageSize int64
+		files       fakeFiles
+		rejected    bool
+	}{
+		{"within the limit", 500, fakeFiles{content: strings.Repeat("x", 500), reportedSize: 500}, false},
+		{"message reports too large", 5000, fakeFiles{content: "x", reportedSize: 1}, true},
+		{"getFile reports too large", 0, fakeFiles{content: "x", reportedSize: 5000}, true},
+		{"content length too large", 0, fakeFiles{content: strings.Repeat("x", 5000)}, true},
+		{"streamed content too large", 0, fakeFiles{content: strings.Repeat("x", 5000), chunked: true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := tt.files
+			server := httptest.NewServer(&files)
+			defer server.Close()
+
+			bot, err := tgbotapi.NewBotAPIWithAPIEndpoint("token", server.URL+"/bot%s/%s")
+			if err != nil {
+				t.Fatal(err)
+			}
+			log, err := logger.NewLoggerWithOutput(io.Discard, slog.LevelError.String(), "text")
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := NewMessageHandler(bot, &config.Config{
+				BaseFileURL:   server.URL + "/file/bot%s/%s",
+				MaxFileSize:   limit,
+				RetryAttempts: 1,
+			}, nil, nil, nil, log)
+
+			body, _, err := h.downloadFile(context.Background(), attachment{fileID: "file", fileName: "scan.pdf", fileSize: tt.messageSize})
+			if err == nil {
+				_, err = io.ReadAll(body)
+				body.Close()
+			}
+
+			var rejected *FileRejectedError
+			if got := errors.As(err, &rejected); got != tt.rejected {
+				t.Errorf("rejected = %v (err %v), want %v", got, err, tt.rejected)
+			}
+		})
+	}
+}
@@ -1,105 +1,247 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"path/filepath"
+	"path"
 	"strings"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"telegram-message-receiver/config"
 	"telegram-message-receiver/logger"
+	"telegram-message-receiver/metrics"
+	"telegram-message-receiver/retry"
 	"telegram-message-receiver/storage"
+	"telegram-message-receiver/transcode"
+	"telegram-message-receiver/transcribe"
 )
 
+// maxMessageLength is the most characters Telegram accepts in a single text message
+const maxMessageLength = 4096
+
 type MessageHandler struct {
 	bot     *tgbotapi.BotAPI
 	config  *config.Config
 	storage storage.MessageStorage
 	logger  *logger.Logger
+
+	// httpClient downloads files; retryPolicy applies to downloads and Telegram API calls
+	httpClient  *http.Client
+	retryPolicy retry.Policy
+
+	// transcriber turns voice messages into text and transcoder converts them to other
+	// formats; either may be nil to disable that step
+	transcriber transcribe.Transcriber
+	transcoder  *transcode.FFmpeg
+
+	commands *CommandRouter
 }
 
-func NewMessageHandler(bot *tgbotapi.BotAPI, config *config.Config, storage storage.MessageStorage, logger *logger.Logger) *MessageHandler {
-	return &MessageHandler{
-		bot:     bot,
-		config:  config,
-		storage: storage,
-		logger:  logger,
+func NewMessageHandler(bot *tgbotapi.BotAPI, config *config.Config, storage storage.MessageStorage, transcriber transcribe.Transcriber, transcoder *transcode.FFmpeg, logger *logger.Logger) *MessageHandler {
+	h := &MessageHandler{
+		bot:         bot,
+		config:      config,
+		storage:     storage,
+		transcriber: transcriber,
+		transcoder:  transcoder,
+		logger:      logger,
+		httpClient:  retry.NewHTTPClient(config.DownloadTimeout, config.ConnectTimeout),
+		retryPolicy: retry.Policy{
+			Attempts:  config.RetryAttempts,
+			BaseDelay: config.RetryBaseDelay,
+			MaxDelay:  config.RetryMaxDelay,
+		},
+		commands: NewCommandRouter(),
 	}
+
+	h.RegisterCommand(Command{Name: "start", Description: "Start the bot", Permission: PermissionPublic, Handler: h.startCommand})
+	h.RegisterCommand(Command{Name: "help", Description: "List the available commands", Permission: PermissionPublic, Handler: h.helpCommand})
+	h.registerAdminCommands()
+	return h
+}
+
+// HandleUpdate handles a single update; updates other than messages are ignored
+func (h *MessageHandler) HandleUpdate(ctx context.Context, update tgbotapi.Update) error {
+	metrics.UpdatesReceived.WithLabelValues(updateType(update)).Inc()
+
+	if update.Message == nil {
+		return nil
+	}
+
+	ctx = logger.NewContext(ctx, h.log(ctx).With("update_id", update.UpdateID))
+	return h.HandleMessage(ctx, update.Message)
 }
 
-func (h *MessageHandler) HandleMessage(message *tgbotapi.Message) error {
+func (h *MessageHandler) HandleMessage(ctx context.Context, message *tgbotapi.Message) error {
 	if message == nil {
 		return fmt.Errorf("received nil message")
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Channel posts and some service messages have no sender to store them under or answer
+	if message.From == nil {
+		h.log(ctx).Debug("Ignoring message without a sender", "chat_id", message.Chat.ID, "message_id", message.MessageID)
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.HandleMessageDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	username := h.sanitizeUsername(message.From.UserName)
-	timestamp := time.Now()
+	info := h.messageInfo(message, username)
+
+	// Everything logged while handling this message, including by storage, carries these fields
+	ctx = logger.NewContext(ctx, h.log(ctx).With("chat_id", info.ChatID, "message_id", info.MessageID, "username", username))
 
 	// Log message receipt
-	h.logger.Debug("Received message from %s (Chat ID: %d)", username, message.Chat.ID)
+	h.log(ctx).Debug("Received message")
+
+	name := h.commandOf(message)
+	command, registered := h.commands.Lookup(name)
+
+	// Admin commands come before the blocked chat check and the contact gate: they aren't
+	// stored, and admins don't need to share a contact. runCommand skips them when redelivered.
+	if registered && command.Permission == PermissionAdmin && h.permitted(message, command.Permission) {
+		return h.runCommand(ctx, command, message)
+	}
+
+	blocked, err := h.storage.IsBlocked(ctx, info.ChatID)
+	if err != nil {
+		h.log(ctx).Error("Error checking blocked chat", "error", err)
+		return err
+	}
+	if blocked {
+		metrics.BlockedMessages.Inc()
+		h.log(ctx).Debug("Dropping message from blocked chat")
+		return nil
+	}
+
+	// Updates replayed after a restart are skipped before anything is downloaded again
+	stored, err := h.storage.HasMessage(ctx, info.ChatID, info.MessageID)
+	if err != nil {
+		h.log(ctx).Error("Error checking for duplicate message", "error", err)
+		return err
+	}
+	if stored {
+		h.log(ctx).Debug("Skipping message already stored")
+		return nil
+	}
+
+	if registered && command.Permission == PermissionPublic {
+		return h.runCommand(ctx, command, message)
+	}
 
 	// Check if user has shared contact info (except for contact sharing message)
 	if message.Contact == nil {
-		hasContact, err := h.storage.HasContactInfo(message.Chat.ID)
+		hasContact, err := h.storage.HasContactInfo(ctx, message.Chat.ID)
 		if err != nil {
-			h.logger.Error("Error checking contact info: %v", err)
+			h.log(ctx).Error("Error checking contact info", "error", err)
 			return err
 		}
 
 		if !hasContact {
-			return h.requestContact(message.Chat.ID)
+			metrics.ContactGateRejections.Inc()
+			return h.requestContact(ctx, message.Chat.ID)
+		}
+	}
+
+	// Commands aren't stored; unknown ones and those the user may not run get the same answer
+	if name != "" {
+		if registered && h.permitted(message, command.Permission) {
+			return h.runCommand(ctx, command, message)
 		}
+		return h.unknownCommand(ctx, message.Chat.ID)
 	}
 
 	switch {
 	case message.Contact != nil:
-		return h.handleContactMessage(message)
+		return h.handleContactMessage(ctx, message)
 	case message.Voice != nil:
-		return h.handleVoiceMessage(message.Chat.ID, username, message.Voice, timestamp)
-	case message.Text == "/start":
-		return h.handleStartCommand(message.Chat.ID)
+		return h.handleVoiceMessage(ctx, info, message)
+	case len(message.Photo) > 0:
+		// Telegram sends several sizes of the same photo, the last one is the largest
+		photo := message.Photo[len(message.Photo)-1]
+		return h.handleMediaMessage(ctx, info, storage.MediaPhoto, attachment{
+			fileID:       photo.FileID,
+			fileUniqueID: photo.FileUniqueID,
+			mimeType:     "image/jpeg",
+			fileSize:     int64(photo.FileSize),
+		})
+	case message.Document != nil:
+		return h.handleMediaMessage(ctx, info, storage.MediaDocument, attachment{
+			fileID:       message.Document.FileID,
+			fileUniqueID: message.Document.FileUniqueID,
+			fileName:     message.Document.FileName,
+			mimeType:     message.Document.MimeType,
+			fileSize:     int64(message.Document.FileSize),
+		})
+	case message.Audio != nil:
+		return h.handleMediaMessage(ctx, info, storage.MediaAudio, attachment{
+			fileID:       message.Audio.FileID,
+			fileUniqueID: message.Audio.FileUniqueID,
+			fileName:     message.Audio.FileName,
+			mimeType:     message.Audio.MimeType,
+			fileSize:     int64(message.Audio.FileSize),
+		})
+	case message.Video != nil:
+		return h.handleMediaMessage(ctx, info, storage.MediaVideo, attachment{
+			fileID:       message.Video.FileID,
+			fileUniqueID: message.Video.FileUniqueID,
+			fileName:     message.Video.FileName,
+			mimeType:     message.Video.MimeType,
+			fileSize:     int64(message.Video.FileSize),
+		})
+	case message.VideoNote != nil:
+		return h.handleMediaMessage(ctx, info, storage.MediaVideoNote, attachment{
+			fileID:       message.VideoNote.FileID,
+			fileUniqueID: message.VideoNote.FileUniqueID,
+			mimeType:     "video/mp4",
+			fileSize:     int64(message.VideoNote.FileSize),
+		})
 	case message.Text != "":
-		return h.handleTextMessage(message.Chat.ID, username, message.Text, timestamp)
+		return h.handleTextMessage(ctx, info, message.Text)
 	default:
-		h.logger.Info("Unsupported message type received from %s", username)
+		h.log(ctx).Info("Unsupported message type received")
 		return nil
 	}
 }
 
-func (h *MessageHandler) handleContactMessage(message *tgbotapi.Message) error {
+func (h *MessageHandler) handleContactMessage(ctx context.Context, message *tgbotapi.Message) error {
 	if message.Contact == nil {
 		return fmt.Errorf("no contact information in message")
 	}
 
 	username := h.sanitizeUsername(message.From.UserName)
-	h.logger.Debug("Processing contact information from %s", username)
+	h.log(ctx).Debug("Processing contact information")
 
 	// Verify that the shared contact belongs to the user
 	if message.Contact.UserID != 0 && message.Contact.UserID != message.From.ID {
 		msg := tgbotapi.NewMessage(message.Chat.ID, "Please share your own contact information.")
-		_, err := h.bot.Send(msg)
-		return err
+		return h.send(ctx, msg)
 	}
 
 	// Save contact information
-	if err := h.storage.SaveContactInfo(message.Chat.ID, username, message.Contact.PhoneNumber, time.Now()); err != nil {
+	if err := h.storage.SaveContactInfo(ctx, message.Chat.ID, username, message.Contact.PhoneNumber, time.Now()); err != nil {
 		return fmt.Errorf("failed to save contact information: %w", err)
 	}
 
 	// Remove contact keyboard and send welcome message
-	msg := tgbotapi.NewMessage(message.Chat.ID, "Thank you! You can now use the bot freely. Send me any message or voice recording.")
+	msg := tgbotapi.NewMessage(message.Chat.ID, "Thank you! You can now use the bot freely. Send me any message, voice recording or file.")
 	msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-	_, err := h.bot.Send(msg)
-	return err
+	return h.send(ctx, msg)
 }
 
-func (h *MessageHandler) handleStartCommand(chatID int64) error {
-	hasContact, err := h.storage.HasContactInfo(chatID)
+func (h *MessageHandler) handleStartCommand(ctx context.Context, chatID int64) error {
+	hasContact, err := h.storage.HasContactInfo(ctx, chatID)
 	if err != nil {
-		h.logger.Error("Error checking contact info: %v", err)
+		h.log(ctx).Error("Error checking contact info", "error", err)
 		return err
 	}
 
@@ -107,17 +249,17 @@ func (h *MessageHandler) handleStartCommand(chatID int64) error {
 		welcomeText := `Welcome back! 👋
 						You can:
 						• Send text messages
-						• Send voice messages`
+						• Send voice messages
+						• Send photos, videos, audio files and documents`
 
 		msg := tgbotapi.NewMessage(chatID, welcomeText)
-		_, err := h.bot.Send(msg)
-		return err
+		return h.send(ctx, msg)
 	}
 
-	return h.requestContact(chatID)
+	return h.requestContact(ctx, chatID)
 }
 
-func (h *MessageHandler) requestContact(chatID int64) error {
+func (h *MessageHandler) requestContact(ctx context.Context, chatID int64) error {
 	keyboard := tgbotapi.NewReplyKeyboard(
 		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButtonContact("📱 Share Contact"),
@@ -128,36 +270,82 @@ func (h *MessageHandler) requestContact(chatID int64) error {
 
 	msg := tgbotapi.NewMessage(chatID, "👋 Welcome! To start using this bot, please share your contact information:")
 	msg.ReplyMarkup = keyboard
-	_, err := h.bot.Send(msg)
-	return err
+	return h.send(ctx, msg)
 }
 
-func (h *MessageHandler) handleVoiceMessage(chatID int64, username string, voice *tgbotapi.Voice, timestamp time.Time) error {
-	h.logger.Debug("Processing voice message from %s (Duration: %d seconds)", username, voice.Duration)
+func (h *MessageHandler) handleMediaMessage(ctx context.Context, info storage.MessageInfo, kind storage.MediaKind, att attachment) error {
+	h.log(ctx).Debug("Processing media message", "kind", kind)
+
+	media := storage.MediaInfo{
+		MessageInfo:  info,
+		Kind:         kind,
+		FileName:     att.fileName,
+		FileUniqueID: att.fileUniqueID,
+	}
 
-	file, err := h.downloadFile(voice.FileID)
+	// A file that was stored before, e.g. when the same document is forwarded again, isn't downloaded again
+	linked, err := h.storage.SaveMediaReference(ctx, media)
 	if err != nil {
-		return fmt.Errorf("failed to download voice message: %w", err)
+		return h.handleDownloadError(ctx, info.ChatID, string(kind), err)
+	}
+	if linked {
+		return nil
+	}
+
+	file, fileInfo, err := h.downloadFile(ctx, att)
+	if err != nil {
+		return h.handleDownloadError(ctx, info.ChatID, string(kind), err)
 	}
 	defer file.Close()
 
-	return h.storage.SaveVoiceMessage(chatID, username, file, timestamp)
+	// Photos and video notes have no original name, fall back to the one Telegram stores them under
+	if media.FileName == "" {
+		media.FileName = path.Base(fileInfo.FilePath)
+	}
+
+	if err := h.storage.SaveMediaFile(ctx, media, file); err != nil {
+		return h.handleDownloadError(ctx, info.ChatID, string(kind), err)
+	}
+
+	return nil
+}
+
+// handleDownloadError tells the user why a file was refused, or wraps any other failure for the caller
+func (h *MessageHandler) handleDownloadError(ctx context.Context, chatID int64, what string, err error) error {
+	if errors.Is(err, storage.ErrDuplicateMessage) {
+		h.log(ctx).Debug("Skipping message already stored", "kind", what)
+		return nil
+	}
+
+	var rejected *FileRejectedError
+	if !errors.As(err, &rejected) {
+		return fmt.Errorf("failed to process %s: %w", what, err)
+	}
+
+	h.log(ctx).Info("Rejected file", "kind", what, "reason", rejected.Reason)
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ Your %s was not saved: %s.", strings.ReplaceAll(what, "_", " "), rejected.Reason))
+	return h.send(ctx, msg)
 }
 
-func (h *MessageHandler) handleTextMessage(chatID int64, username, text string, timestamp time.Time) error {
-	h.logger.Debug("Processing text message from %s (Length: %d)", username, len(text))
+func (h *MessageHandler) handleTextMessage(ctx context.Context, info storage.MessageInfo, text string) error {
+	h.log(ctx).Debug("Processing text message", "length", len(text))
 
 	// Filter out any potentially harmful characters from text
 	sanitizedText := h.sanitizeText(text)
 
-	if err := h.storage.SaveTextMessage(chatID, username, sanitizedText, timestamp); err != nil {
+	err := h.storage.SaveTextMessage(ctx, storage.TextMessage{MessageInfo: info, Text: sanitizedText})
+	if errors.Is(err, storage.ErrDuplicateMessage) {
+		h.log(ctx).Debug("Skipping message already stored")
+		return nil
+	}
+	if err != nil {
 		return fmt.Errorf("failed to save text message: %w", err)
 	}
 
 	// If configured, send acknowledgment
 	if h.config.SendAcknowledgment {
-		if err := h.sendAcknowledgment(chatID); err != nil {
-			h.logger.Error("Failed to send acknowledgment: %v", err)
+		if err := h.sendAcknowledgment(ctx, info.ChatID); err != nil {
+			h.log(ctx).Error("Failed to send acknowledgment", "error", err)
 			// Don't return error as the message was saved successfully
 		}
 	}
@@ -165,25 +353,82 @@ func (h *MessageHandler) handleTextMessage(chatID int64, username, text string,
 	return nil
 }
 
-func (h *MessageHandler) downloadFile(fileID string) (io.ReadCloser, error) {
-	file, err := h.bot.GetFile(tgbotapi.FileConfig{FileID: fileID})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get file info: %w", err)
+// messageInfo collects the identifying metadata of a message for storage
+func (h *MessageHandler) messageInfo(message *tgbotapi.Message, username string) storage.MessageInfo {
+	info := storage.MessageInfo{
+		MessageID: message.MessageID,
+		ChatID:    message.Chat.ID,
+		Username:  username,
+		Timestamp: message.Time(),
+	}
+	if message.From != nil {
+		info.UserID = message.From.ID
+	}
+	if message.ReplyToMessage != nil {
+		info.ReplyToID = message.ReplyToMessage.MessageID
 	}
+	return info
+}
 
-	fileURL := fmt.Sprintf(h.config.BaseFileURL, h.bot.Token, file.FilePath)
+// send sends a message to a chat, retrying transient failures and counting the ones that stick in metrics
+func (h *MessageHandler) send(ctx context.Context, msg tgbotapi.Chattable) error {
+	_, err := h.sendMessage(ctx, msg)
+	return err
+}
 
-	resp, err := http.Get(fileURL)
+// sendMessage is send returning the message as Telegram delivered it. Only failures known to
+// have sent nothing are retried, since the user would get a message twice otherwise.
+func (h *MessageHandler) sendMessage(ctx context.Context, msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var sent tgbotapi.Message
+	err := h.retry(ctx, "send message", func() error {
+		var err error
+		sent, err = h.bot.Send(msg)
+		if err != nil && !retry.Unsent(err) {
+			return retry.Permanent(err)
+		}
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to download file: %w", err)
+		metrics.SendErrors.Inc()
+		return sent, err
 	}
+	return sent, nil
+}
+
+// retry runs op under the configured retry policy, logging every retry
+func (h *MessageHandler) retry(ctx context.Context, what string, op func() error) error {
+	return retry.Do(ctx, h.retryPolicy, op, func(attempt int, delay time.Duration, err error) {
+		h.log(ctx).Warn("Retrying "+what, "attempt", attempt, "delay", delay, "error", err)
+	})
+}
 
-	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, fmt.Errorf("failed to download file: status code %d", resp.StatusCode)
+// updateType names the kind of update for metrics
+func updateType(update tgbotapi.Update) string {
+	switch {
+	case update.Message != nil:
+		return "message"
+	case update.EditedMessage != nil:
+		return "edited_message"
+	case update.ChannelPost != nil:
+		return "channel_post"
+	case update.EditedChannelPost != nil:
+		return "edited_channel_post"
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	case update.InlineQuery != nil:
+		return "inline_query"
+	case update.MyChatMember != nil:
+		return "my_chat_member"
+	case update.ChatMember != nil:
+		return "chat_member"
+	default:
+		return "other"
 	}
+}
 
-	return resp.Body, nil
+// log returns the logger carrying the fields of the message being handled
+func (h *MessageHandler) log(ctx context.Context) *logger.Logger {
+	return logger.FromContext(ctx, h.logger)
 }
 
 func (h *MessageHandler) sanitizeUsername(username string) string {
@@ -210,20 +455,7 @@ func (h *MessageHandler) sanitizeText(text string) string {
 	}, text)
 }
 
-func (h *MessageHandler) sendAcknowledgment(chatID int64) error {
+func (h *MessageHandler) sendAcknowledgment(ctx context.Context, chatID int64) error {
 	msg := tgbotapi.NewMessage(chatID, h.config.AcknowledgmentMessage)
-	_, err := h.bot.Send(msg)
-	return err
-}
-
-// ValidateFileType checks if the file extension is allowed
-func (h *MessageHandler) validateFileType(filename string) bool {
-	ext := strings.ToLower(filepath.Ext(filename))
-	allowedTypes := map[string]bool{
-		".ogg": true,
-		".mp3": true,
-		".wav": true,
-		".m4a": true,
-	}
-	return allowedTypes[ext]
+	return h.send(ctx, msg)
 }
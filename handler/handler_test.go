@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/config"
+	"telegram-message-receiver/logger"
+	"telegram-message-receiver/storage"
+)
+
+// sentMessage is a message or document the handler sent through fakeTelegram
+type sentMessage struct {
+	chatID  int64
+	text    string
+	replyTo int
+	// document is the name of an uploaded file, which text then holds the content of
+	document string
+}
+
+// fakeTelegram answers the Bot API calls the handler makes, serves files to download and
+// records what was sent
+type fakeTelegram struct {
+	// files maps file IDs to the content downloads return
+	files map[string]string
+	// failSends makes Telegram refuse every message
+	failSends bool
+
+	mu     sync.Mutex
+	sent   []sentMessage
+	nextID int
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if fileID, ok := strings.CutPrefix(path.Base(r.URL.Path), "file_"); ok && strings.HasPrefix(r.URL.Path, "/file/") {
+		io.WriteString(w, f.files[fileID])
+		return
+	}
+
+	var result interface{} = true
+	switch method := path.Base(r.URL.Path); method {
+	case "getMe":
+		result = tgbotapi.User{ID: 1, IsBot: true, UserName: "test_bot"}
+	case "getFile":
+		fileID := r.FormValue("file_id")
+		result = tgbotapi.File{FileID: fileID, FileSize: len(f.files[fileID]), FilePath: "files/file_" + fileID}
+	case "sendMessage", "sendDocument":
+		if f.failSends {
+			json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: false, ErrorCode: 400, Description: "Bad Request: chat not found"})
+			return
+		}
+		result = f.record(r, method == "sendDocument")
+	}
+
+	raw, _ := json.Marshal(result)
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: true, Result: raw})
+}
+
+func (f *fakeTelegram) record(r *http.Request, document bool) tgbotapi.Message {
+	chatID, _ := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+	replyTo, _ := strconv.Atoi(r.FormValue("reply_to_message_id"))
+	sent := sentMessage{chatID: chatID, text: r.FormValue("text"), replyTo: replyTo}
+	if document {
+		file, header, err := r.FormFile("document")
+		if err == nil {
+			data, _ := io.ReadAll(file)
+			file.Close()
+			sent.document, sent.text = header.Filename, string(data)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	f.sent = append(f.sent, sent)
+	return tgbotapi.Message{MessageID: 1000 + f.nextID, Chat: &tgbotapi.Chat{ID: chatID}, Date: int(time.Now().Unix()), Text: sent.text}
+}
+
+// messages returns what was sent so far
+func (f *fakeTelegram) messages() []sentMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]sentMessage(nil), f.sent...)
+}
+
+func newTestLogger(t *testing.T) *logger.Logger {
+	t.Helper()
+	logger, err := logger.NewLoggerWithOutput(io.Discard, slog.LevelError.String(), "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger
+}
+
+// newTestHandler returns a handler talking to telegram and storing into a LocalStorage at
+// cfg.StoragePath, a temporary directory unless set. cfg may be nil.
+func newTestHandler(t *testing.T, telegram *fakeTelegram, cfg *config.Config) (*MessageHandler, *storage.LocalStorage) {
+	t.Helper()
+	server := httptest.NewServer(telegram)
+	t.Cleanup(server.Close)
+
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint("token", server.URL+"/bot%s/%s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	cfg.BaseFileURL = server.URL + "/file/bot%s/%s"
+	cfg.RetryAttempts = 1
+	if cfg.TranscribeTimeout == 0 {
+		cfg.TranscribeTimeout = time.Minute
+	}
+	if cfg.StoragePath == "" {
+		cfg.StoragePath = t.TempDir()
+	}
+
+	log := newTestLogger(t)
+	s := storage.NewLocalStorage(cfg.StoragePath, log)
+	return NewMessageHandler(bot, cfg, s, nil, nil, log), s
+}
+
+// shareContact stores a contact for chatID, letting its messages past the contact gate
+func shareContact(t *testing.T, s storage.MessageStorage, chatID int64) {
+	t.Helper()
+	if err := s.SaveContactInfo(context.Background(), chatID, "user", "+100", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// textMessage is a private message from user chatID; text starting with a slash is a command
+func textMessage(messageID int, chatID int64, text string) *tgbotapi.Message {
+	message := &tgbotapi.Message{
+		MessageID: messageID,
+		From:      &tgbotapi.User{ID: chatID, UserName: "user"},
+		Chat:      &tgbotapi.Chat{ID: chatID, Type: "private"},
+		Date:      int(time.Now().Unix()),
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		command, _, _ := strings.Cut(text, " ")
+		message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+	}
+	return message
+}
+
+func TestHandleMessageWithoutSender(t *testing.T) {
+	ctx := context.Background()
+	telegram := &fakeTelegram{}
+	h, s := newTestHandler(t, telegram, &config.Config{AdminUserIDs: []int64{0}})
+	shareContact(t, s, 5)
+
+	for i, text := range []string{"hello", "/help", "/stats"} {
+		message := textMessage(i+1, 5, text)
+		message.From = nil
+		if err := h.HandleMessage(ctx, message); err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+		if stored, err := s.HasMessage(ctx, 5, i+1); err != nil || stored {
+			t.Errorf("%q: stored = %v, %v", text, stored, err)
+		}
+	}
+	if sent := telegram.messages(); len(sent) != 0 {
+		t.Errorf("sent %+v to messages without a sender", sent)
+	}
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/metrics"
+	"telegram-message-receiver/storage"
+)
+
+var (
+	// ErrInvalidReply is returned for replies that are refused before anything is sent
+	ErrInvalidReply = errors.New("invalid reply")
+	// ErrReplyNotSent wraps the error of a reply Telegram didn't take
+	ErrReplyNotSent = errors.New("reply not sent")
+)
+
+// SendReply sends text to a chat the bot has heard from on an operator's behalf, as a reply to
+// the stored message replyToID unless it is zero. The sent message is stored in the chat's
+// history, marked as outbound.
+func (h *MessageHandler) SendReply(ctx context.Context, chatID int64, text string, replyToID int) (storage.TextMessage, error) {
+	if strings.TrimSpace(text) == "" {
+		return storage.TextMessage{}, fmt.Errorf("%w: text is empty", ErrInvalidReply)
+	}
+	if utf8.RuneCountInString(text) > maxMessageLength {
+		return storage.TextMessage{}, fmt.Errorf("%w: text is longer than %d characters", ErrInvalidReply, maxMessageLength)
+	}
+
+	chat, err := h.findChat(ctx, chatID)
+	if err != nil {
+		return storage.TextMessage{}, err
+	}
+	if chat == nil {
+		return storage.TextMessage{}, fmt.Errorf("%w: no messages received from chat %d", ErrInvalidReply, chatID)
+	}
+	if chat.Blocked {
+		return storage.TextMessage{}, fmt.Errorf("%w: chat %d is blocked", ErrInvalidReply, chatID)
+	}
+	if replyToID != 0 {
+		stored, err := h.storage.HasMessage(ctx, chatID, replyToID)
+		if err != nil {
+			return storage.TextMessage{}, fmt.Errorf("failed to look up message %d: %w", replyToID, err)
+		}
+		if !stored {
+			return storage.TextMessage{}, fmt.Errorf("%w: message %d of chat %d is not stored", ErrInvalidReply, replyToID, chatID)
+		}
+	}
+
+	return h.deliverReply(ctx, *chat, text, replyToID)
+}
+
+// deliverReply sends a reply that passed validation and stores it
+func (h *MessageHandler) deliverReply(ctx context.Context, chat storage.Chat, text string, replyToID int) (storage.TextMessage, error) {
+	msg := tgbotapi.NewMessage(chat.ChatID, text)
+	msg.ReplyToMessageID = replyToID
+	sent, err := h.sendMessage(ctx, msg)
+	if err != nil {
+		return storage.TextMessage{}, fmt.Errorf("%w: %w", ErrReplyNotSent, err)
+	}
+	metrics.RepliesSent.Inc()
+
+	// Stored under the chat's username so it lands in the same conversation as the messages
+	// received from it
+	reply := storage.TextMessage{
+		MessageInfo: storage.MessageInfo{
+			MessageID: sent.MessageID,
+			ChatID:    chat.ChatID,
+			UserID:    h.bot.Self.ID,
+			Username:  chat.Username,
+			Timestamp: sent.Time(),
+			ReplyToID: replyToID,
+			Outbound:  true,
+		},
+		Text: text,
+	}
+	if err := h.storage.SaveTextMessage(ctx, reply); err != nil {
+		return reply, fmt.Errorf("reply %d was sent but not stored: %w", sent.MessageID, err)
+	}
+
+	h.log(ctx).Info("Reply sent", "chat_id", chat.ChatID, "message_id", sent.MessageID, "reply_to_id", replyToID)
+	return reply, nil
+}
+
+// findChat returns the chat with chatID, or nil if the bot hasn't heard from it
+func (h *MessageHandler) findChat(ctx context.Context, chatID int64) (*storage.Chat, error) {
+	chats, err := h.storage.ListChats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up chat: %w", err)
+	}
+	for _, chat := range chats {
+		if chat.ChatID == chatID {
+			return &chat, nil
+		}
+	}
+	return nil, nil
+}
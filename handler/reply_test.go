@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"telegram-message-receiver/storage"
+)
+
+var errDiskFull = errors.New("disk full")
+
+// unwritableTexts is a storage that refuses to store text messages
+type unwritableTexts struct {
+	storage.MessageStorage
+}
+
+func (unwritableTexts) SaveTextMessage(ctx context.Context, message storage.TextMessage) error {
+	return errDiskFull
+}
+
+func TestSendReply(t *testing.T) {
+	tests := []struct {
+		name      string
+		chatID    int64
+		text      string
+		replyToID int
+		failSends bool
+		failStore bool
+		wantErr   error
+	}{
+		{name: "sent", chatID: 5, text: "hi", replyToID: 1},
+		{name: "sent without reply", chatID: 5, text: "hi"},
+		{name: "empty", chatID: 5, text: " \n", wantErr: ErrInvalidReply},
+		{name: "too long", chatID: 5, text: strings.Repeat("a", maxMessageLength+1), wantErr: ErrInvalidReply},
+		{name: "unknown chat", chatID: 7, text: "hi", wantErr: ErrInvalidReply},
+		{name: "blocked chat", chatID: 6, text: "hi", wantErr: ErrInvalidReply},
+		{name: "reply to unknown message", chatID: 5, text: "hi", replyToID: 99, wantErr: ErrInvalidReply},
+		{name: "refused by Telegram", chatID: 5, text: "hi", failSends: true, wantErr: ErrReplyNotSent},
+		{name: "sent but not stored", chatID: 5, text: "hi", failStore: true, wantErr: errDiskFull},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			telegram := &fakeTelegram{failSends: tt.failSends}
+			h, s := newTestHandler(t, telegram, nil)
+			for _, chatID := range []int64{5, 6} {
+				info := storage.MessageInfo{MessageID: 1, ChatID: chatID, UserID: chatID, Username: "user", Timestamp: time.Now().Add(-time.Minute)}
+				if err := s.SaveTextMessage(ctx, storage.TextMessage{MessageInfo: info, Text: "hello"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.SetBlocked(ctx, 6, true); err != nil {
+				t.Fatal(err)
+			}
+			if tt.failStore {
+				h.storage = unwritableTexts{s}
+			}
+
+			reply, err := h.SendReply(ctx, tt.chatID, tt.text, tt.replyToID)
+			if !errors.Is(err, tt.wantErr) || (err != nil) != (tt.wantErr != nil) {
+				t.Fatalf("SendReply = %v, want %v", err, tt.wantErr)
+			}
+
+			// Callers tell a reply that was sent apart by its message ID
+			delivered := tt.wantErr == nil || tt.failStore
+			if (reply.MessageID != 0) != delivered {
+				t.Errorf("reply message ID %d, want one: %v", reply.MessageID, delivered)
+			}
+			sent := telegram.messages()
+			if delivered != (len(sent) == 1) || len(sent) > 1 {
+				t.Fatalf("sent %+v, want the reply sent: %v", sent, delivered)
+			}
+			if delivered && (sent[0].chatID != tt.chatID || sent[0].text != tt.text || sent[0].replyTo != tt.replyToID) {
+				t.Errorf("sent %+v, want %q to chat %d in reply to %d", sent[0], tt.text, tt.chatID, tt.replyToID)
+			}
+
+			messages, err := s.ListMessages(ctx, storage.MessageFilter{ChatID: 5})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != nil {
+				if len(messages) != 1 {
+					t.Errorf("stored %+v, want only the received message", messages)
+				}
+				return
+			}
+			if len(messages) != 2 {
+				t.Fatalf("stored %+v, want the received message and the reply", messages)
+			}
+			if got := messages[1]; !got.Outbound || got.Text != tt.text || got.MessageID != reply.MessageID ||
+				got.ReplyToID != tt.replyToID || got.UserID != h.bot.Self.ID || got.Username != "user" {
+				t.Errorf("stored reply %+v, want it outbound from the bot in the user's conversation", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/metrics"
+	"telegram-message-receiver/storage"
+)
+
+// transcribeVoice transcribes a stored voice message, saves the transcript and, if configured,
+// replies with it. The recording is already stored, so failures are logged rather than returned.
+func (h *MessageHandler) transcribeVoice(ctx context.Context, info storage.MessageInfo, audioPath string) {
+	transcribeCtx, cancel := context.WithTimeout(ctx, h.config.TranscribeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	text, err := h.transcriber.Transcribe(transcribeCtx, audioPath)
+	metrics.TranscriptionDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.Transcriptions.WithLabelValues(metrics.ResultError).Inc()
+		h.log(ctx).Error("Failed to transcribe voice message", "error", err)
+		return
+	}
+	metrics.Transcriptions.WithLabelValues(metrics.ResultOK).Inc()
+
+	if text == "" {
+		h.log(ctx).Debug("Voice message transcript is empty")
+		return
+	}
+
+	if err := h.storage.SaveTranscript(ctx, info, text); err != nil {
+		h.log(ctx).Error("Failed to save transcript", "error", err)
+		return
+	}
+
+	if h.config.TranscribeReply {
+		msg := tgbotapi.NewMessage(info.ChatID, truncate("📝 "+text, maxMessageLength))
+		msg.ReplyToMessageID = info.MessageID
+		if err := h.send(ctx, msg); err != nil {
+			h.log(ctx).Error("Failed to send transcript", "error", err)
+		}
+	}
+}
+
+// truncate shortens text to at most limit characters, marking the cut with an ellipsis
+func truncate(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-1]) + "…"
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/storage"
+)
+
+func (h *MessageHandler) handleVoiceMessage(ctx context.Context, info storage.MessageInfo, message *tgbotapi.Message) error {
+	voice := message.Voice
+	h.log(ctx).Debug("Processing voice message", "duration", voice.Duration)
+
+	voiceInfo := storage.VoiceInfo{
+		MessageInfo:   info,
+		FileID:        voice.FileID,
+		FileUniqueID:  voice.FileUniqueID,
+		Duration:      voice.Duration,
+		MimeType:      voice.MimeType,
+		FileSize:      int64(voice.FileSize),
+		Caption:       h.sanitizeText(message.Caption),
+		ForwardOrigin: forwardOrigin(message),
+	}
+
+	// Transcoding and transcription need the audio, so only a recording that isn't processed
+	// further can be shared with an earlier copy without downloading it
+	process := h.transcriber != nil || h.transcoder != nil
+	if !process {
+		linked, err := h.storage.SaveVoiceReference(ctx, voiceInfo)
+		if err != nil {
+			return h.handleDownloadError(ctx, info.ChatID, "voice message", err)
+		}
+		if linked {
+			return nil
+		}
+	}
+
+	file, _, err := h.downloadFile(ctx, attachment{
+		fileID:       voice.FileID,
+		fileUniqueID: voice.FileUniqueID,
+		fileName:     "voice.ogg",
+		mimeType:     voice.MimeType,
+		fileSize:     int64(voice.FileSize),
+	})
+	if err != nil {
+		return h.handleDownloadError(ctx, info.ChatID, "voice message", err)
+	}
+	defer file.Close()
+
+	if !process {
+		if err := h.storage.SaveVoiceMessage(ctx, voiceInfo, file); err != nil {
+			return h.handleDownloadError(ctx, info.ChatID, "voice message", err)
+		}
+		return nil
+	}
+
+	// Transcoding and transcription work on files, so keep a copy of the recording while it is stored
+	workDir, err := os.MkdirTemp("", "voice-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	audioPath := filepath.Join(workDir, "voice.ogg")
+	spool, err := os.Create(audioPath)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer spool.Close()
+
+	if err := h.storage.SaveVoiceMessage(ctx, voiceInfo, io.TeeReader(file, spool)); err != nil {
+		return h.handleDownloadError(ctx, info.ChatID, "voice message", err)
+	}
+
+	// The recording is stored at this point, so the steps below log their failures instead of
+	// failing the message
+	if h.transcoder != nil {
+		for _, format := range h.transcodeVoice(ctx, info, audioPath, workDir) {
+			// whisper.cpp reads WAV natively, which saves it decoding Opus
+			if format == "wav" {
+				audioPath = filepath.Join(workDir, "voice.wav")
+			}
+		}
+	}
+
+	if h.transcriber != nil {
+		h.transcribeVoice(ctx, info, audioPath)
+	}
+	return nil
+}
+
+// transcodeVoice converts the recording at inputPath to every configured format, writing the
+// results to workDir and storing them, and returns the formats that were stored
+func (h *MessageHandler) transcodeVoice(ctx context.Context, info storage.MessageInfo, inputPath, workDir string) []string {
+	transcodeCtx, cancel := context.WithTimeout(ctx, h.config.TranscodeTimeout)
+	defer cancel()
+
+	var stored []string
+	for _, format := range h.transcoder.Formats() {
+		outputPath := filepath.Join(workDir, "voice."+format)
+		if err := h.transcoder.Transcode(transcodeCtx, inputPath, format, outputPath); err != nil {
+			h.log(ctx).Error("Failed to transcode voice message", "format", format, "error", err)
+			continue
+		}
+
+		if err := h.saveVoiceVariant(ctx, info, format, outputPath); err != nil {
+			h.log(ctx).Error("Failed to save voice variant", "format", format, "error", err)
+			continue
+		}
+		stored = append(stored, format)
+	}
+	return stored
+}
+
+func (h *MessageHandler) saveVoiceVariant(ctx context.Context, info storage.MessageInfo, format, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return h.storage.SaveVoiceVariant(ctx, info, format, file)
+}
+
+// forwardOrigin returns where a forwarded message was originally sent, or nil if it wasn't forwarded
+func forwardOrigin(message *tgbotapi.Message) *storage.ForwardOrigin {
+	if message.ForwardDate == 0 {
+		return nil
+	}
+
+	origin := &storage.ForwardOrigin{
+		SenderName: message.ForwardSenderName,
+		MessageID:  message.ForwardFromMessageID,
+		Signature:  message.ForwardSignature,
+		Date:       time.Unix(int64(message.ForwardDate), 0),
+	}
+	if message.ForwardFrom != nil {
+		origin.UserID = message.ForwardFrom.ID
+		origin.Username = message.ForwardFrom.UserName
+	}
+	if message.ForwardFromChat != nil {
+		origin.ChatID = message.ForwardFromChat.ID
+		origin.ChatTitle = message.ForwardFromChat.Title
+	}
+	return origin
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/config"
+	"telegram-message-receiver/logger"
+	"telegram-message-receiver/transcribe"
+)
+
+// voiceMessage is a voice message from user chatID whose recording telegram serves as "voice"
+func voiceMessage(messageID int, chatID int64, telegram *fakeTelegram) *tgbotapi.Message {
+	telegram.files = map[string]string{"voice": "ogg data"}
+	message := textMessage(messageID, chatID, "")
+	message.Voice = &tgbotapi.Voice{FileID: "voice", FileUniqueID: "voice-unique", Duration: 2, MimeType: "audio/ogg", FileSize: len("ogg data")}
+	return message
+}
+
+// storedTranscript returns the transcript stored next to the only voice message, or "" if there is none
+func storedTranscript(t *testing.T, cfg *config.Config) string {
+	t.Helper()
+	recordings, err := filepath.Glob(filepath.Join(cfg.StoragePath, "voices", "*", "*.ogg"))
+	if err != nil || len(recordings) != 1 {
+		t.Fatalf("stored recordings %v, %v, want one", recordings, err)
+	}
+
+	data, err := os.ReadFile(strings.TrimSuffix(recordings[0], ".ogg") + ".txt")
+	if errors.Is(err, os.ErrNotExist) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(string(data), "\n")
+}
+
+func TestVoiceTranscription(t *testing.T) {
+	tests := []struct {
+		name           string
+		reply          bool
+		transcriber    *transcribe.Fake
+		wantTranscript string
+		wantReply      string
+	}{
+		{name: "saved", transcriber: &transcribe.Fake{Text: "hello there"}, wantTranscript: "hello there"},
+		{name: "replied", reply: true, transcriber: &transcribe.Fake{Text: "hello there"}, wantTranscript: "hello there", wantReply: "📝 hello there"},
+		{name: "empty", reply: true, transcriber: &transcribe.Fake{}},
+		{name: "failed", reply: true, transcriber: &transcribe.Fake{Err: errors.New("model missing")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			telegram := &fakeTelegram{}
+			cfg := &config.Config{TranscribeReply: tt.reply}
+			h, s := newTestHandler(t, telegram, cfg)
+			h.transcriber = tt.transcriber
+			shareContact(t, s, 5)
+
+			var logs bytes.Buffer
+			log, err := logger.NewLoggerWithOutput(&logs, slog.LevelError.String(), "text")
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.logger = log
+
+			message := voiceMessage(7, 5, telegram)
+			if err := h.HandleMessage(ctx, message); err != nil {
+				t.Fatalf("HandleMessage = %v", err)
+			}
+			if stored, err := s.HasMessage(ctx, 5, 7); err != nil || !stored {
+				t.Fatalf("voice message stored = %v, %v", stored, err)
+			}
+			if calls := tt.transcriber.Calls(); len(calls) != 1 {
+				t.Errorf("transcriber called with %v, want once", calls)
+			}
+
+			if got := storedTranscript(t, cfg); got != tt.wantTranscript {
+				t.Errorf("stored transcript %q, want %q", got, tt.wantTranscript)
+			}
+
+			sent := telegram.messages()
+			if tt.wantReply == "" && len(sent) != 0 {
+				t.Errorf("sent %+v, want nothing", sent)
+			}
+			if tt.wantReply != "" && (len(sent) != 1 || sent[0].text != tt.wantReply || sent[0].replyTo != 7) {
+				t.Errorf("sent %+v, want %q in reply to message 7", sent, tt.wantReply)
+			}
+
+			failed := strings.Contains(logs.String(), "Failed to transcribe voice message")
+			if failed != (tt.transcriber.Err != nil) {
+				t.Errorf("logged %q, want a transcription failure: %v", logs.String(), tt.transcriber.Err != nil)
+			}
+		})
+	}
+}
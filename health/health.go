@@ -0,0 +1,90 @@
+package health
+
+import (
+	"context"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/receiver"
+	"telegram-message-receiver/storage"
+)
+
+// storageCheckTimeout bounds how long a readiness probe waits for storage
+const storageCheckTimeout = 5 * time.Second
+
+// Checker reports whether the bot is receiving updates and able to store them
+type Checker struct {
+	bot      *tgbotapi.BotAPI
+	storage  storage.MessageStorage
+	receiver receiver.Receiver
+	started  time.Time
+
+	// maxContactAge is how long the receiver may go without hearing from Telegram before the
+	// bot counts as unhealthy; zero disables the check (e.g. for webhooks, which only hear
+	// from Telegram when there are updates)
+	maxContactAge time.Duration
+}
+
+// Status is the JSON body returned by the health endpoints
+type Status struct {
+	Healthy bool `json:"healthy"`
+	Bot     struct {
+		ID       int64  `json:"id"`
+		Username string `json:"username"`
+	} `json:"bot"`
+	LastContact             *time.Time `json:"last_contact,omitempty"`
+	SecondsSinceLastContact *float64   `json:"seconds_since_last_contact,omitempty"`
+	Storage                 string     `json:"storage,omitempty"`
+	Errors                  []string   `json:"errors,omitempty"`
+}
+
+func NewChecker(bot *tgbotapi.BotAPI, storage storage.MessageStorage, receiver receiver.Receiver, maxContactAge time.Duration) *Checker {
+	return &Checker{
+		bot:           bot,
+		storage:       storage,
+		receiver:      receiver,
+		started:       time.Now(),
+		maxContactAge: maxContactAge,
+	}
+}
+
+// Live reports whether the receiver is still hearing from Telegram
+func (c *Checker) Live() Status {
+	status := Status{Healthy: true}
+	status.Bot.ID = c.bot.Self.ID
+	status.Bot.Username = c.bot.Self.UserName
+
+	// Before the first contact, measure from startup so a slow first poll isn't reported as stale
+	since := c.started
+	if last := c.receiver.LastContact(); !last.IsZero() {
+		since = last
+		seconds := time.Since(last).Seconds()
+		status.LastContact = &last
+		status.SecondsSinceLastContact = &seconds
+	}
+
+	if c.maxContactAge > 0 && time.Since(since) > c.maxContactAge {
+		status.Healthy = false
+		status.Errors = append(status.Errors, "no contact with Telegram for "+time.Since(since).Round(time.Second).String())
+	}
+
+	return status
+}
+
+// Ready reports whether the bot is live and its storage accepts writes
+func (c *Checker) Ready(ctx context.Context) Status {
+	status := c.Live()
+
+	ctx, cancel := context.WithTimeout(ctx, storageCheckTimeout)
+	defer cancel()
+
+	if err := c.storage.Check(ctx); err != nil {
+		status.Healthy = false
+		status.Storage = "unavailable"
+		status.Errors = append(status.Errors, err.Error())
+	} else {
+		status.Storage = "ok"
+	}
+
+	return status
+}
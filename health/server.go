@@ -0,0 +1,79 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"telegram-message-receiver/logger"
+)
+
+// Server serves /healthz (liveness) and /readyz (readiness) for container orchestrators
+type Server struct {
+	addr    string
+	checker *Checker
+	logger  *logger.Logger
+	server  *http.Server
+}
+
+func NewServer(addr string, checker *Checker, logger *logger.Logger) *Server {
+	return &Server{
+		addr:    addr,
+		checker: checker,
+		logger:  logger,
+	}
+}
+
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s.writeStatus(w, s.checker.Live())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s.writeStatus(w, s.checker.Ready(r.Context()))
+	})
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Health server stopped", "error", err)
+		}
+	}()
+
+	s.logger.Info("Serving health checks", "addr", s.addr)
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	if err := s.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down health server: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) writeStatus(w http.ResponseWriter, status Status) {
+	code := http.StatusOK
+	if !status.Healthy {
+		code = http.StatusServiceUnavailable
+		s.logger.Warn("Health check failed", "errors", status.Errors)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
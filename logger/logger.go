@@ -2,47 +2,77 @@
 package logger
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
 )
 
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Logger is a leveled, structured logger. Key/value pairs passed after the message,
+// or attached with With, are emitted as fields of the log record.
 type Logger struct {
-	debug   *log.Logger
-	info    *log.Logger
-	error   *log.Logger
-	isDebug bool
+	*slog.Logger
 }
 
-// NewLogger creates a new Logger instance
-func NewLogger(debug bool) *Logger {
-	flags := log.Ldate | log.Ltime | log.LUTC | log.Lshortfile
+// NewLogger creates a Logger writing to stdout at the given level
+// ("debug", "info", "warn" or "error") in the given format ("text" or "json")
+func NewLogger(level, format string) (*Logger, error) {
+	return NewLoggerWithOutput(os.Stdout, level, format)
+}
 
-	return &Logger{
-		debug:   log.New(os.Stdout, "DEBUG: ", flags),
-		info:    log.New(os.Stdout, "INFO: ", flags),
-		error:   log.New(os.Stderr, "ERROR: ", flags),
-		isDebug: debug,
+// NewLoggerWithOutput is like NewLogger but writes to w
+func NewLoggerWithOutput(w io.Writer, level, format string) (*Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
 	}
-}
 
-func (l *Logger) Debug(format string, v ...interface{}) {
-	if l.isDebug {
-		l.debug.Printf(format, v...)
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case FormatText, "":
+		handler = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be %q or %q", format, FormatText, FormatJSON)
 	}
+
+	return &Logger{slog.New(handler)}, nil
 }
 
-func (l *Logger) Info(format string, v ...interface{}) {
-	l.info.Printf(format, v...)
+// With returns a Logger that adds the given key/value pairs to every record
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{l.Logger.With(args...)}
 }
 
-func (l *Logger) Error(format string, v ...interface{}) {
-	l.error.Printf(format, v...)
+// StdLogger returns a standard library logger that writes through this Logger at the
+// given level, for libraries that only accept a *log.Logger
+func (l *Logger) StdLogger(level slog.Level) *log.Logger {
+	return slog.NewLogLogger(l.Handler(), level)
 }
 
-// SetOutput allows changing the output writer for all loggers
-func (l *Logger) SetOutput(w io.Writer) {
-	l.debug.SetOutput(w)
-	l.info.SetOutput(w)
-	l.error.SetOutput(w)
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l, so code further down the call chain logs
+// with the same fields (chat_id, message_id, update_id, ...)
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the Logger stored in ctx by NewContext, or fallback if there is none
+func FromContext(ctx context.Context, fallback *Logger) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return fallback
 }
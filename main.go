@@ -1,15 +1,30 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"telegram-message-receiver/api"
 	"telegram-message-receiver/config"
+	"telegram-message-receiver/deadletter"
+	"telegram-message-receiver/dispatcher"
 	"telegram-message-receiver/handler"
+	"telegram-message-receiver/health"
 	"telegram-message-receiver/logger"
+	"telegram-message-receiver/metrics"
+	"telegram-message-receiver/receiver"
+	"telegram-message-receiver/retry"
+	"telegram-message-receiver/s3"
 	"telegram-message-receiver/storage"
+	"telegram-message-receiver/transcode"
+	"telegram-message-receiver/transcribe"
+	"telegram-message-receiver/webui"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joho/godotenv"
@@ -20,46 +35,305 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	config, err := config.LoadConfig()
 	if err != nil {
 		log.Fatal("Error loading config:", err)
 	}
 
-	logger := logger.NewLogger(config.Debug)
+	logger, err := logger.NewLogger(config.LogLevel, config.LogFormat)
+	if err != nil {
+		log.Fatal("Error creating logger:", err)
+	}
+
+	// Route the standard library logger, which tgbotapi also writes to, through the same sink
+	slog.SetDefault(logger.Logger)
+	tgbotapi.SetLogger(logger.StdLogger(slog.LevelInfo))
 
-	bot, err := tgbotapi.NewBotAPI(config.TelegramToken)
+	bot, err := newBot(config)
 	if err != nil {
-		logger.Error("Error starting bot: %v", err)
+		logger.Error("Error starting bot", "error", err)
 		os.Exit(1)
 	}
 
 	bot.Debug = config.Debug
 
-	storage := storage.NewLocalStorage(config.StoragePath)
-	handler := handler.NewMessageHandler(bot, config, storage, logger)
+	storage, err := newStorage(config, logger)
+	if err != nil {
+		logger.Error("Error opening storage", "error", err)
+		os.Exit(1)
+	}
+
+	transcoder, err := newTranscoder(config)
+	if err != nil {
+		logger.Error("Error configuring transcoding", "error", err)
+		os.Exit(1)
+	}
+
+	handler := handler.NewMessageHandler(bot, config, storage, newTranscriber(config), transcoder, logger)
+
+	// The bot works without the command menu, so failing to set it isn't fatal
+	if err := handler.PublishCommands(context.Background()); err != nil {
+		logger.Warn("Error publishing bot commands", "error", err)
+	}
+
+	deadLetters := deadletter.NewStore(config.DeadLetterPath, config.DeadLetterRetryDelay)
 
-	updateConfig := tgbotapi.NewUpdate(0)
-	updateConfig.Timeout = 60
+	var metricsServer *metrics.Server
+	if config.MetricsAddr != "" {
+		metricsServer = metrics.NewServer(config.MetricsAddr, logger)
+		if err := metricsServer.Start(); err != nil {
+			logger.Error("Error starting metrics server", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	updates := bot.GetUpdatesChan(updateConfig)
+	var apiServer *api.Server
+	if config.APIAddr != "" {
+		apiServer = api.NewServer(config.APIAddr, config.APIToken, storage, handler, logger)
+		if err := apiServer.Start(); err != nil {
+			logger.Error("Error starting API server", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var webUIServer *webui.Server
+	if config.WebUIAddr != "" {
+		webUIServer, err = webui.NewServer(config.WebUIAddr, config.WebUIUsername, config.WebUIPassword, storage, logger)
+		if err != nil {
+			logger.Error("Error creating web UI server", "error", err)
+			os.Exit(1)
+		}
+		if err := webUIServer.Start(); err != nil {
+			logger.Error("Error starting web UI server", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	lastUpdateID, err := storage.LoadUpdateOffset(context.Background())
+	if err != nil {
+		logger.Error("Error loading update offset", "error", err)
+		os.Exit(1)
+	}
+
+	receiver, err := receiver.NewReceiver(bot, config, logger, lastUpdateID)
+	if err != nil {
+		logger.Error("Error creating receiver", "error", err)
+		os.Exit(1)
+	}
+
+	// Handled updates can be confirmed to Telegram even if saving the offset failed
+	offsets := dispatcher.NewOffsetTracker(func(updateID int) error {
+		receiver.Acknowledge(updateID)
+		return storage.SaveUpdateOffset(context.Background(), updateID)
+	})
+
+	updates, err := receiver.Start()
+	if err != nil {
+		logger.Error("Error starting receiver", "error", err)
+		os.Exit(1)
+	}
+
+	healthServer := health.NewServer(config.HealthAddr, health.NewChecker(bot, storage, receiver, maxContactAge(config)), logger)
+	if err := healthServer.Start(); err != nil {
+		logger.Error("Error starting health server", "error", err)
+		os.Exit(1)
+	}
+
+	// finish acknowledges an update, dead-lettering it first if it failed. Failed updates are
+	// acknowledged too since they are kept as dead letters, so one bad message can't hold back
+	// the offset forever. That includes updates interrupted by shutdown: Telegram won't send
+	// them again once they were received, so the dead letter is the only copy left.
+	finish := func(update tgbotapi.Update, err error) {
+		if err != nil {
+			logger.Error("Error handling update", "update_id", update.UpdateID, "error", err)
+			if err := deadLetters.Add(update, err); err != nil {
+				logger.Error("Error dead-lettering update", "update_id", update.UpdateID, "error", err)
+			}
+		}
+		if err := offsets.Done(update.UpdateID); err != nil {
+			logger.Error("Error saving update offset", "update_id", update.UpdateID, "error", err)
+		}
+	}
+
+	dispatcher := dispatcher.NewDispatcher(config.WorkerCount, config.WorkerQueueSize, func(ctx context.Context, update tgbotapi.Update) {
+		finish(update, handler.HandleUpdate(ctx, update))
+	})
+
+	// dispatch queues an update for handling, or finishes it as failed if ctx is done first
+	dispatch := func(ctx context.Context, update tgbotapi.Update) error {
+		offsets.Received(update.UpdateID)
+		if err := dispatcher.Dispatch(ctx, update); err != nil {
+			finish(update, fmt.Errorf("not handled before shutdown: %w", err))
+			return err
+		}
+		return nil
+	}
+	// Retries go through the dispatcher so they are never handled alongside newer updates of their chat
+	reprocessor := deadletter.NewReprocessor(deadLetters, func(ctx context.Context, update tgbotapi.Update) error {
+		return dispatcher.Run(ctx, update, handler.HandleUpdate)
+	}, config.DeadLetterMaxAttempts, logger)
+
+	dispatcher.Start()
+	reprocessor.Start()
 
 	// Graceful shutdown handling
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		<-sigChan
-		logger.Info("Shutting down gracefully...")
-		os.Exit(0)
-	}()
-
-	for update := range updates {
-		if update.Message == nil {
-			continue
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+receive:
+	for {
+		select {
+		case <-ctx.Done():
+			break receive
+		case update, ok := <-updates:
+			if !ok {
+				break receive
+			}
+			if err := dispatch(ctx, update); err != nil {
+				break receive
+			}
+		}
+	}
+
+	logger.Info("Shutting down gracefully")
+	if err := receiver.Stop(); err != nil {
+		logger.Error("Error stopping receiver", "error", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	// Updates already accepted by the receiver would be lost if we dropped them here
+	drainUpdates(shutdownCtx, updates, dispatch)
+
+	// Stopped first since it hands retries to the dispatcher
+	reprocessor.Stop()
+
+	// Returns only once no handler is running, so nothing writes to storage after it's closed
+	if err := dispatcher.Stop(shutdownCtx); err != nil {
+		logger.Error("Error waiting for in-flight messages", "error", err)
+	}
+
+	// Stopped before storage is closed since they read from it
+	if apiServer != nil {
+		if err := apiServer.Stop(shutdownCtx); err != nil {
+			logger.Error("Error stopping API server", "error", err)
+		}
+	}
+	if webUIServer != nil {
+		if err := webUIServer.Stop(shutdownCtx); err != nil {
+			logger.Error("Error stopping web UI server", "error", err)
+		}
+	}
+
+	if err := storage.Close(); err != nil {
+		logger.Error("Error closing storage", "error", err)
+	}
+
+	if err := healthServer.Stop(shutdownCtx); err != nil {
+		logger.Error("Error stopping health server", "error", err)
+	}
+
+	// Stopped last so the final counts can still be scraped while the bot drains
+	if metricsServer != nil {
+		if err := metricsServer.Stop(shutdownCtx); err != nil {
+			logger.Error("Error stopping metrics server", "error", err)
 		}
+	}
+
+	logger.Info("Shutdown complete")
+}
 
-		if err := handler.HandleMessage(update.Message); err != nil {
-			logger.Error("Error handling message: %v", err)
+// drainUpdates dispatches the updates still buffered in the receiver's channel. Once ctx is
+// done, dispatch dead-letters the remaining ones instead.
+func drainUpdates(ctx context.Context, updates tgbotapi.UpdatesChannel, dispatch func(context.Context, tgbotapi.Update) error) {
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			dispatch(ctx, update)
+		default:
+			return
 		}
 	}
 }
+
+func newBot(cfg *config.Config) (*tgbotapi.BotAPI, error) {
+	return tgbotapi.NewBotAPIWithClient(cfg.TelegramToken, tgbotapi.APIEndpoint, retry.NewHTTPClient(cfg.APITimeout, cfg.ConnectTimeout))
+}
+
+// newTranscriber returns the configured transcriber, or nil if transcription is disabled
+func newTranscriber(cfg *config.Config) transcribe.Transcriber {
+	switch cfg.Transcriber {
+	case config.TranscriberWhisper:
+		return transcribe.NewWhisper(cfg.WhisperBinary, cfg.WhisperModel, cfg.WhisperLanguage)
+	default:
+		return nil
+	}
+}
+
+// newTranscoder returns an ffmpeg transcoder for the configured formats, or nil if transcoding is disabled
+func newTranscoder(cfg *config.Config) (*transcode.FFmpeg, error) {
+	if len(cfg.TranscodeFormats) == 0 {
+		return nil, nil
+	}
+	return transcode.NewFFmpeg(cfg.FFmpegBinary, cfg.TranscodeFormats)
+}
+
+func newStorage(cfg *config.Config, logger *logger.Logger) (storage.MessageStorage, error) {
+	switch cfg.StorageBackend {
+	case config.StorageBackendSQLite:
+		media, err := newMediaStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewSQLiteStorage(cfg.SQLitePath, media, cfg.SQLiteStoreMediaDB, logger)
+	case config.StorageBackendPostgres:
+		media, err := newMediaStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewPostgresStorage(cfg.PostgresDSN, storage.PostgresPool{
+			MaxConns:        cfg.PostgresMaxConns,
+			MaxIdleConns:    cfg.PostgresMaxIdleConns,
+			ConnMaxLifetime: cfg.PostgresConnMaxLifetime,
+		}, media, logger)
+	default:
+		return storage.NewLocalStorage(cfg.StoragePath, logger), nil
+	}
+}
+
+// newMediaStore returns where media content is kept by storage backends that support a choice
+func newMediaStore(cfg *config.Config) (storage.MediaStore, error) {
+	if cfg.MediaBackend != config.MediaBackendS3 {
+		return storage.NewFileMediaStore(cfg.StoragePath), nil
+	}
+
+	return s3.NewStore(s3.Config{
+		Endpoint:        cfg.S3Endpoint,
+		Region:          cfg.S3Region,
+		Bucket:          cfg.S3Bucket,
+		Prefix:          cfg.S3Prefix,
+		AccessKeyID:     cfg.S3AccessKeyID,
+		SecretAccessKey: cfg.S3SecretAccessKey,
+		PathStyle:       cfg.S3PathStyle,
+	}, retry.NewHTTPClient(cfg.DownloadTimeout, cfg.ConnectTimeout))
+}
+
+// maxContactAge returns how long the receiver may go without hearing from Telegram before the
+// bot is unhealthy. Webhooks only hear from Telegram when there are updates, so only polling can go stale.
+func maxContactAge(cfg *config.Config) time.Duration {
+	if cfg.UpdateMode == config.UpdateModeWebhook {
+		return 0
+	}
+	return cfg.HealthMaxPollAge
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "telegram_receiver"
+
+var (
+	UpdatesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_received_total",
+		Help:      "Updates received from Telegram, by update type.",
+	}, []string{"type"})
+
+	MessagesStored = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_stored_total",
+		Help:      "Messages written to storage, by kind.",
+	}, []string{"kind"})
+
+	MediaDeduplicated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "media_deduplicated_total",
+		Help:      "Attachments stored as a reference to identical content stored before.",
+	})
+
+	DownloadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "download_bytes_total",
+		Help:      "Bytes downloaded from the Telegram file API.",
+	})
+
+	DownloadFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "download_failures_total",
+		Help:      "File downloads that failed, by reason (rejected, telegram, http).",
+	}, []string{"reason"})
+
+	ContactGateRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "contact_gate_rejections_total",
+		Help:      "Messages refused because the sender has not shared contact information yet.",
+	})
+
+	BlockedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocked_messages_total",
+		Help:      "Messages dropped because their chat was blocked by an admin.",
+	})
+
+	CommandsHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "commands_handled_total",
+		Help:      "Bot commands run, by command.",
+	}, []string{"command"})
+
+	SendErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_send_errors_total",
+		Help:      "Messages the bot failed to send through the Telegram API.",
+	})
+
+	RepliesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "replies_sent_total",
+		Help:      "Replies sent to users on an operator's behalf.",
+	})
+
+	DeadLettered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_dead_lettered_total",
+		Help:      "Updates that failed to process and were added to the dead-letter store.",
+	})
+
+	DeadLettersRecovered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dead_letters_recovered_total",
+		Help:      "Dead-lettered updates that were processed successfully on a later attempt.",
+	})
+
+	Transcriptions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transcriptions_total",
+		Help:      "Voice messages transcribed, by result (ok, error).",
+	}, []string{"result"})
+
+	HandleMessageDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handle_message_duration_seconds",
+		Help:      "Time taken to handle a message, including downloads and storage.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 8),
+	})
+
+	DownloadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "download_duration_seconds",
+		Help:      "Time taken to download a file from Telegram, until its body was fully read.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 3, 8),
+	})
+
+	TranscriptionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "transcription_duration_seconds",
+		Help:      "Time taken to transcribe a voice message.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+)
+
+// Results recorded by Transcriptions
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+// Reasons recorded by DownloadFailures
+const (
+	DownloadRejected = "rejected"
+	DownloadTelegram = "telegram"
+	DownloadHTTP     = "http"
+)
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"telegram-message-receiver/logger"
+)
+
+// Server exposes the registered metrics at /metrics in the Prometheus text format
+type Server struct {
+	addr   string
+	logger *logger.Logger
+	server *http.Server
+}
+
+func NewServer(addr string, logger *logger.Logger) *Server {
+	return &Server{
+		addr:   addr,
+		logger: logger,
+	}
+}
+
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Metrics server stopped", "error", err)
+		}
+	}()
+
+	s.logger.Info("Serving metrics", "addr", s.addr)
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	if err := s.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down metrics server: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package receiver
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/config"
+	"telegram-message-receiver/logger"
+)
+
+// Receiver delivers incoming Telegram updates to the application.
+type Receiver interface {
+	// Start begins receiving updates and returns the channel they are delivered on.
+	Start() (tgbotapi.UpdatesChannel, error)
+	// Stop stops receiving updates and releases any resources held by the receiver.
+	Stop() error
+	// LastContact returns when the receiver last heard from Telegram, or the zero time if it never did.
+	LastContact() time.Time
+	// Acknowledge tells the receiver that updateID and every update before it have been handled.
+	Acknowledge(updateID int)
+}
+
+// NewReceiver creates the receiver selected by config.UpdateMode. lastUpdateID is the last
+// update that was already handled; polling resumes right after it.
+func NewReceiver(bot *tgbotapi.BotAPI, cfg *config.Config, logger *logger.Logger, lastUpdateID int) (Receiver, error) {
+	switch cfg.UpdateMode {
+	case "", config.UpdateModePolling:
+		return NewPollingReceiver(bot, logger, lastUpdateID), nil
+	case config.UpdateModeWebhook:
+		return NewWebhookReceiver(bot, cfg, logger), nil
+	default:
+		return nil, fmt.Errorf("unknown update mode %q", cfg.UpdateMode)
+	}
+}
+
+// pollRetryDelay is how long polling waits after a failed getUpdates call
+const pollRetryDelay = 3 * time.Second
+
+// inFlightPollDelay is how long polling waits for an acknowledgement before asking Telegram
+// again when every update it returned is still being handled
+const inFlightPollDelay = time.Second
+
+// PollingReceiver receives updates with getUpdates. Telegram treats every update before the
+// requested offset as confirmed and never sends it again, so the offset only moves past
+// updates the application acknowledged. Updates in flight are returned again by the next
+// calls and skipped, which bounds them to the size of one getUpdates batch (100 updates).
+type PollingReceiver struct {
+	bot          *tgbotapi.BotAPI
+	logger       *logger.Logger
+	lastUpdateID int
+	updates      chan tgbotapi.Update
+	done         chan struct{}
+
+	// acknowledged is the last update ID passed to Acknowledge; acked signals that it moved
+	acknowledged atomic.Int64
+	acked        chan struct{}
+
+	// lastPoll is the time of the last successful getUpdates call in Unix nanoseconds
+	lastPoll atomic.Int64
+}
+
+func NewPollingReceiver(bot *tgbotapi.BotAPI, logger *logger.Logger, lastUpdateID int) *PollingReceiver {
+	r := &PollingReceiver{
+		bot:          bot,
+		logger:       logger,
+		lastUpdateID: lastUpdateID,
+		updates:      make(chan tgbotapi.Update, bot.Buffer),
+		done:         make(chan struct{}),
+		acked:        make(chan struct{}, 1),
+	}
+	r.acknowledged.Store(int64(lastUpdateID))
+	return r
+}
+
+func (r *PollingReceiver) Start() (tgbotapi.UpdatesChannel, error) {
+	// A registered webhook makes getUpdates fail, so make sure none is left over
+	if _, err := r.bot.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		return nil, fmt.Errorf("failed to delete webhook: %w", err)
+	}
+
+	updateConfig := tgbotapi.NewUpdate(r.offset())
+	updateConfig.Timeout = 60
+
+	r.logger.Info("Receiving updates via long polling", "offset", updateConfig.Offset)
+	go r.poll(updateConfig)
+	return r.updates, nil
+}
+
+// poll calls getUpdates until Stop is called. It replaces tgbotapi's GetUpdatesChan so the
+// time of the last successful call can be reported by LastContact, and so the offset follows
+// the acknowledged updates rather than the received ones.
+func (r *PollingReceiver) poll(updateConfig tgbotapi.UpdateConfig) {
+	defer close(r.updates)
+
+	// delivered is the last update sent on the channel
+	delivered := r.lastUpdateID
+	for {
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+
+		updateConfig.Offset = r.offset()
+		updates, err := r.bot.GetUpdates(updateConfig)
+		if err != nil {
+			r.logger.Error("Failed to get updates", "error", err, "retry_in", pollRetryDelay)
+			select {
+			case <-r.done:
+				return
+			case <-time.After(pollRetryDelay):
+			}
+			continue
+		}
+		r.lastPoll.Store(time.Now().UnixNano())
+
+		fresh := 0
+		for _, update := range updates {
+			// Still in flight; Telegram keeps returning it until it is acknowledged
+			if update.UpdateID <= delivered {
+				continue
+			}
+			delivered = update.UpdateID
+			fresh++
+
+			// Updates dropped here aren't acknowledged, so Telegram delivers them again after a restart
+			select {
+			case r.updates <- update:
+			case <-r.done:
+				return
+			}
+		}
+
+		// Telegram answers right away while updates are in flight, so asking again before one
+		// of them is acknowledged would only return the same batch
+		if len(updates) > 0 && fresh == 0 {
+			select {
+			case <-r.done:
+				return
+			case <-r.acked:
+			case <-time.After(inFlightPollDelay):
+			}
+		}
+	}
+}
+
+// Acknowledge lets the next getUpdates call confirm updateID and the updates before it
+func (r *PollingReceiver) Acknowledge(updateID int) {
+	r.acknowledged.Store(int64(updateID))
+	select {
+	case r.acked <- struct{}{}:
+	default:
+	}
+}
+
+// offset returns the getUpdates offset that confirms exactly the acknowledged updates
+func (r *PollingReceiver) offset() int {
+	if acknowledged := int(r.acknowledged.Load()); acknowledged > 0 {
+		return acknowledged + 1
+	}
+	return 0
+}
+
+// Stop makes the polling loop exit and close the updates channel. A getUpdates call that is
+// still in flight is left to finish in the background.
+func (r *PollingReceiver) Stop() error {
+	close(r.done)
+	return nil
+}
+
+func (r *PollingReceiver) LastContact() time.Time {
+	return unixNanoTime(r.lastPoll.Load())
+}
+
+func unixNanoTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
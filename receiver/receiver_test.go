@@ -0,0 +1,177 @@
+package receiver
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/logger"
+)
+
+// fakeTelegram answers getMe, deleteWebhook and getUpdates like the Bot API, dropping the
+// updates each getUpdates offset confirms
+type fakeTelegram struct {
+	mu      sync.Mutex
+	pending []int
+	offsets []int
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var result interface{} = true
+	switch path.Base(r.URL.Path) {
+	case "getMe":
+		result = tgbotapi.User{ID: 1, IsBot: true, UserName: "test_bot"}
+	case "getUpdates":
+		offset, _ := strconv.Atoi(r.FormValue("offset"))
+		updates := f.getUpdates(offset)
+		if len(updates) == 0 {
+			// Stands in for the long poll
+			time.Sleep(10 * time.Millisecond)
+		}
+		result = updates
+	}
+
+	raw, _ := json.Marshal(result)
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: true, Result: raw})
+}
+
+func (f *fakeTelegram) getUpdates(offset int) []tgbotapi.Update {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.offsets = append(f.offsets, offset)
+	var updates []tgbotapi.Update
+	var kept []int
+	for _, id := range f.pending {
+		if id < offset {
+			continue
+		}
+		kept = append(kept, id)
+		updates = append(updates, tgbotapi.Update{UpdateID: id})
+	}
+	f.pending = kept
+	return updates
+}
+
+func (f *fakeTelegram) add(ids ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = append(f.pending, ids...)
+}
+
+// lastOffset returns the offset of the latest getUpdates call
+func (f *fakeTelegram) lastOffset() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.offsets[len(f.offsets)-1]
+}
+
+func newTestBot(t *testing.T, handler http.Handler) *tgbotapi.BotAPI {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint("token", server.URL+"/bot%s/%s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot
+}
+
+func newTestLogger(t *testing.T) *logger.Logger {
+	t.Helper()
+	logger, err := logger.NewLoggerWithOutput(io.Discard, slog.LevelError.String(), "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger
+}
+
+func receive(t *testing.T, updates tgbotapi.UpdatesChannel) int {
+	t.Helper()
+	select {
+	case update := <-updates:
+		return update.UpdateID
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update received")
+		return 0
+	}
+}
+
+func expectNothing(t *testing.T, updates tgbotapi.UpdatesChannel) {
+	t.Helper()
+	select {
+	case update := <-updates:
+		t.Fatalf("update %d delivered again", update.UpdateID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPollingOffsetFollowsAcknowledgements(t *testing.T) {
+	telegram := &fakeTelegram{}
+	telegram.add(11, 12, 13)
+
+	r := NewPollingReceiver(newTestBot(t, telegram), newTestLogger(t), 10)
+	updates, err := r.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	for _, want := range []int{11, 12, 13} {
+		if got := receive(t, updates); got != want {
+			t.Fatalf("received update %d, want %d", got, want)
+		}
+	}
+	// Updates in flight are returned by Telegram again, but not delivered twice
+	expectNothing(t, updates)
+	if got := telegram.lastOffset(); got != 11 {
+		t.Errorf("offset %d confirms updates that weren't acknowledged, want 11", got)
+	}
+
+	r.Acknowledge(12)
+	telegram.add(14)
+	if got := receive(t, updates); got != 14 {
+		t.Fatalf("received update %d, want 14", got)
+	}
+	expectNothing(t, updates)
+	if got := telegram.lastOffset(); got != 13 {
+		t.Errorf("offset = %d after acknowledging 12, want 13", got)
+	}
+}
+
+func TestPollingResumesAfterUnacknowledgedUpdates(t *testing.T) {
+	telegram := &fakeTelegram{}
+	telegram.add(11, 12)
+
+	bot := newTestBot(t, telegram)
+	first := NewPollingReceiver(bot, newTestLogger(t), 10)
+	updates, err := first.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, updates)
+	receive(t, updates)
+	first.Acknowledge(11)
+	first.Stop()
+
+	// A restart from the saved offset gets the update that was never acknowledged
+	second := NewPollingReceiver(bot, newTestLogger(t), 11)
+	updates, err = second.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Stop()
+
+	if got := receive(t, updates); got != 12 {
+		t.Fatalf("received update %d after restart, want 12", got)
+	}
+}
@@ -0,0 +1,181 @@
+package receiver
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"telegram-message-receiver/config"
+	"telegram-message-receiver/logger"
+)
+
+// secretTokenHeader is set by Telegram on every webhook request when a secret token was registered
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+const shutdownTimeout = 10 * time.Second
+
+type WebhookReceiver struct {
+	bot     *tgbotapi.BotAPI
+	config  *config.Config
+	logger  *logger.Logger
+	server  *http.Server
+	updates chan tgbotapi.Update
+
+	// done is closed when Stop begins so pending requests stop waiting for buffer space;
+	// mu guards closing updates against requests that are still sending on it
+	done   chan struct{}
+	mu     sync.RWMutex
+	closed bool
+
+	// lastContact is the time of the webhook registration or the last accepted update in Unix nanoseconds
+	lastContact atomic.Int64
+}
+
+func NewWebhookReceiver(bot *tgbotapi.BotAPI, config *config.Config, logger *logger.Logger) *WebhookReceiver {
+	return &WebhookReceiver{
+		bot:     bot,
+		config:  config,
+		logger:  logger,
+		updates: make(chan tgbotapi.Update, bot.Buffer),
+		done:    make(chan struct{}),
+	}
+}
+
+func (r *WebhookReceiver) Start() (tgbotapi.UpdatesChannel, error) {
+	// Bind before registering so Telegram never points at a port nobody listens on
+	listener, err := net.Listen("tcp", r.config.WebhookListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", r.config.WebhookListenAddr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(r.config.WebhookPath, r.handleUpdate)
+	r.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		var err error
+		if r.config.WebhookCertFile != "" {
+			err = r.server.ServeTLS(listener, r.config.WebhookCertFile, r.config.WebhookKeyFile)
+		} else {
+			err = r.server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			r.logger.Error("Webhook server stopped", "error", err)
+		}
+	}()
+
+	if err := r.registerWebhook(); err != nil {
+		r.server.Close()
+		return nil, err
+	}
+	r.lastContact.Store(time.Now().UnixNano())
+
+	r.logger.Info("Receiving updates via webhook", "addr", r.config.WebhookListenAddr, "path", r.config.WebhookPath)
+	return r.updates, nil
+}
+
+func (r *WebhookReceiver) Stop() error {
+	var errs []error
+	close(r.done)
+
+	if _, err := r.bot.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		errs = append(errs, fmt.Errorf("failed to delete webhook: %w", err))
+	}
+
+	if r.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := r.server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to shut down webhook server: %w", err))
+		}
+	}
+
+	r.mu.Lock()
+	r.closed = true
+	close(r.updates)
+	r.mu.Unlock()
+
+	return errors.Join(errs...)
+}
+
+func (r *WebhookReceiver) LastContact() time.Time {
+	return unixNanoTime(r.lastContact.Load())
+}
+
+// Acknowledge does nothing: Telegram considers a webhook update delivered once it was answered
+func (r *WebhookReceiver) Acknowledge(updateID int) {}
+
+// registerWebhook calls setWebhook directly because tgbotapi.WebhookConfig has no secret_token field
+func (r *WebhookReceiver) registerWebhook() error {
+	webhookURL, err := url.Parse(r.config.WebhookURL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL: %w", err)
+	}
+
+	params := make(tgbotapi.Params)
+	params["url"] = webhookURL.String()
+	params.AddNonEmpty("secret_token", r.config.WebhookSecretToken)
+
+	if r.config.WebhookUploadCert {
+		files := []tgbotapi.RequestFile{{
+			Name: "certificate",
+			Data: tgbotapi.FilePath(r.config.WebhookCertFile),
+		}}
+		_, err = r.bot.UploadFiles("setWebhook", params, files)
+	} else {
+		_, err = r.bot.MakeRequest("setWebhook", params)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to register webhook: %w", err)
+	}
+
+	return nil
+}
+
+func (r *WebhookReceiver) handleUpdate(w http.ResponseWriter, req *http.Request) {
+	if r.config.WebhookSecretToken != "" {
+		token := req.Header.Get(secretTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(r.config.WebhookSecretToken)) != 1 {
+			r.logger.Warn("Rejected webhook request with invalid secret token", "remote_addr", req.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	update, err := r.bot.HandleUpdate(req)
+	if err != nil {
+		r.logger.Warn("Invalid webhook request", "remote_addr", req.RemoteAddr, "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Telegram redelivers any update that did not get a 200, so refusing during shutdown loses nothing
+	if r.closed {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	select {
+	case r.updates <- *update:
+		r.lastContact.Store(time.Now().UnixNano())
+		w.WriteHeader(http.StatusOK)
+	case <-r.done:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	case <-req.Context().Done():
+	}
+}
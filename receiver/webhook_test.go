@@ -0,0 +1,58 @@
+package receiver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"telegram-message-receiver/config"
+)
+
+func TestWebhookSecretToken(t *testing.T) {
+	const body = `{"update_id": 7, "message": {"message_id": 1, "chat": {"id": 42}, "text": "hi"}}`
+
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		body   string
+		status int
+	}{
+		{"valid token", "s3cret", "s3cret", body, http.StatusOK},
+		{"wrong token", "s3cret", "guess", body, http.StatusForbidden},
+		{"missing token", "s3cret", "", body, http.StatusForbidden},
+		{"token prefix", "s3cret", "s3c", body, http.StatusForbidden},
+		{"no token configured", "", "", body, http.StatusOK},
+		{"valid token, bad body", "s3cret", "s3cret", "{", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewWebhookReceiver(newTestBot(t, &fakeTelegram{}), &config.Config{WebhookSecretToken: tt.secret}, newTestLogger(t))
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(tt.body))
+			if tt.header != "" {
+				req.Header.Set(secretTokenHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.handleUpdate(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			select {
+			case update := <-r.updates:
+				if tt.status != http.StatusOK {
+					t.Errorf("rejected request queued update %d", update.UpdateID)
+				} else if update.UpdateID != 7 || update.Message.Text != "hi" {
+					t.Errorf("queued %+v, want the posted update", update)
+				}
+			default:
+				if tt.status == http.StatusOK {
+					t.Error("accepted update was not queued")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package retry
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewHTTPClient returns a client whose requests fail after timeout in total, and after
+// connectTimeout while connecting or negotiating TLS, so a stalled request gets retried
+// instead of hanging forever
+func NewHTTPClient(timeout, connectTimeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: connectTimeout,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConnsPerHost: 10,
+		},
+	}
+}
@@ -0,0 +1,126 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Policy controls how often and how long Do retries a failing operation
+type Policy struct {
+	// Attempts is the total number of tries, including the first one
+	Attempts int
+	// BaseDelay is the delay before the first retry; it doubles with every further retry up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// NotifyFunc is called before each retry with the attempt that failed, the delay before the next one and the error
+type NotifyFunc func(attempt int, delay time.Duration, err error)
+
+// permanentError stops Do from retrying
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying. Do returns the wrapped error unchanged.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// Do calls op until it succeeds, returns an error that isn't retryable, the policy's attempts are
+// used up or ctx is done. Telegram errors are retried only for 429 and 5xx responses, and a
+// 429 waits for the retry_after Telegram asked for instead of the backoff delay. notify may be nil.
+func Do(ctx context.Context, policy Policy, op func() error, notify NotifyFunc) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if ctx.Err() != nil || attempt >= policy.Attempts || !retryable(err) {
+			return err
+		}
+
+		delay := policy.backoff(attempt)
+		if after := retryAfter(err); after > 0 {
+			delay = after
+		}
+		if notify != nil {
+			notify(attempt, delay, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the delay after the given failed attempt: exponential growth capped at
+// MaxDelay, with jitter so concurrent workers don't retry in lockstep
+func (p Policy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// Equal jitter: somewhere between half and all of the delay
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+func retryable(err error) bool {
+	var apiErr *tgbotapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == 429 || apiErr.Code >= 500
+	}
+	// Anything else is a network or server failure that may well go away
+	return true
+}
+
+// Unsent reports whether a failed Telegram request certainly had no effect, so repeating it
+// can't do it twice: Telegram answered with an error, or no connection could be made. Other
+// network errors, timeouts above all, may hit after Telegram already acted on the request.
+func Unsent(err error) bool {
+	var apiErr *tgbotapi.Error
+	if errors.As(err, &apiErr) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func retryAfter(err error) time.Duration {
+	var apiErr *tgbotapi.Error
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return time.Duration(apiErr.RetryAfter) * time.Second
+	}
+	return 0
+}
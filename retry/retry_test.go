@@ -0,0 +1,85 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestUnsent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"telegram error", &tgbotapi.Error{Code: 500, Message: "Internal Server Error"}, true},
+		{"dial", &url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, true},
+		{"dns", &url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host"}}}, true},
+		{"read", &url.Error{Op: "Post", Err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}}, false},
+		{"timeout", &url.Error{Op: "Post", Err: context.DeadlineExceeded}, false},
+		{"other", errors.New("unexpected EOF"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unsent(tt.err); got != tt.want {
+				t.Errorf("Unsent(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	policy := Policy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+	}{
+		{"network error", errors.New("connection reset"), 3},
+		{"too many requests", &tgbotapi.Error{Code: 429}, 3},
+		{"server error", &tgbotapi.Error{Code: 502}, 3},
+		{"bad request", &tgbotapi.Error{Code: 400}, 1},
+		{"permanent", Permanent(errors.New("timeout after sending")), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := Do(context.Background(), policy, func() error {
+				attempts++
+				return tt.err
+			}, nil)
+
+			if attempts != tt.attempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.attempts)
+			}
+			var permanent *permanentError
+			if err == nil || errors.As(err, &permanent) {
+				t.Errorf("Do returned %v, want the unwrapped error", err)
+			}
+		})
+	}
+}
+
+func TestDoStopsOnSuccess(t *testing.T) {
+	attempts := 0
+	err := Do(context.Background(), Policy{Attempts: 5}, func() error {
+		attempts++
+		if attempts < 2 {
+			return fmt.Errorf("attempt %d failed", attempts)
+		}
+		return nil
+	}, nil)
+
+	if err != nil || attempts != 2 {
+		t.Errorf("Do = %v after %d attempts, want success after 2", err, attempts)
+	}
+}
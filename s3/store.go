@@ -0,0 +1,292 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// partSize is how much of a file is buffered and uploaded at a time. Files up to this size are
+// uploaded in a single request, larger ones as a multipart upload; 5 MiB is the smallest part S3 accepts.
+const partSize = 5 << 20
+
+// Config locates a bucket on an S3-compatible service
+type Config struct {
+	// Endpoint is the service's base URL, e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses the bucket as <endpoint>/<bucket> instead of <bucket>.<endpoint host>,
+	// which is what MinIO and most other S3-compatible services expect
+	PathStyle bool
+}
+
+// Error is an error response from the service
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return strings.TrimSpace(fmt.Sprintf("s3: status code %d %s", e.StatusCode, e.Message))
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// Store keeps media content as objects in a bucket, under keys prefixed with Config.Prefix.
+// It implements storage.MediaStore.
+type Store struct {
+	config   Config
+	endpoint *url.URL
+	signer   signer
+	client   *http.Client
+}
+
+func NewStore(config Config, client *http.Client) (*Store, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+
+	return &Store{
+		config:   config,
+		endpoint: endpoint,
+		signer: signer{
+			accessKeyID:     config.AccessKeyID,
+			secretAccessKey: config.SecretAccessKey,
+			region:          config.Region,
+		},
+		client: client,
+	}, nil
+}
+
+// Put uploads the content of reader as the object key. Only one part of it is held in memory
+// at a time, and no more memory than the content needs when it fits in one part.
+func (s *Store) Put(ctx context.Context, key string, reader io.Reader) (int64, error) {
+	var first bytes.Buffer
+	n, err := io.CopyN(&first, reader, partSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if n < partSize {
+		if _, err := s.do(ctx, http.MethodPut, key, nil, first.Bytes()); err != nil {
+			return 0, fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+		return n, nil
+	}
+
+	// The buffer holding the first part is reused for the ones after it
+	return s.putMultipart(ctx, key, reader, first.Bytes())
+}
+
+// putMultipart uploads first, a full part, and the rest of reader as a multipart upload,
+// aborting it on failure so the parts uploaded so far don't linger in the bucket
+func (s *Store) putMultipart(ctx context.Context, key string, reader io.Reader, first []byte) (int64, error) {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start upload of %s: %w", key, err)
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiated); err != nil || initiated.UploadID == "" {
+		return 0, fmt.Errorf("failed to start upload of %s: unexpected response", key)
+	}
+	uploadID := initiated.UploadID
+
+	size, err := s.uploadParts(ctx, key, uploadID, reader, first)
+	if err != nil {
+		// Use a fresh context, ctx may be the reason the upload failed
+		abortCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		s.do(abortCtx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil)
+		return 0, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return size, nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *Store) uploadParts(ctx context.Context, key, uploadID string, reader io.Reader, buf []byte) (int64, error) {
+	var (
+		parts []completedPart
+		size  int64
+		n     = len(buf)
+	)
+	for number := 1; n > 0; number++ {
+		etag, err := s.uploadPart(ctx, key, uploadID, number, buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+		size += int64(n)
+
+		n, err = io.ReadFull(reader, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return 0, err
+	}
+
+	// Completing can fail after the service has already answered 200, with the error in the body
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return 0, err
+	}
+	if err := responseError(http.StatusOK, resp); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (s *Store) uploadPart(ctx context.Context, key, uploadID string, number int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	req, err := s.newRequest(ctx, http.MethodPut, key, query, data)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return "", responseError(resp.StatusCode, body)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// Open downloads the object key. A missing object returns an error matching os.ErrNotExist.
+func (s *Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: %w", key, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return nil, fmt.Errorf("failed to download %s: %w", key, responseError(resp.StatusCode, body))
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the object key
+func (s *Store) Delete(ctx context.Context, key string) error {
+	if _, err := s.do(ctx, http.MethodDelete, key, nil, nil); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// Check verifies that the bucket exists and the credentials give access to it
+func (s *Store) Check(ctx context.Context) error {
+	if _, err := s.do(ctx, http.MethodHead, "", nil, nil); err != nil {
+		return fmt.Errorf("bucket %s is not accessible: %w", s.config.Bucket, err)
+	}
+	return nil
+}
+
+// do sends a signed request for the object key, or the bucket if key is empty, and returns
+// the response body. Responses other than 2xx are returned as *Error.
+func (s *Store) do(ctx context.Context, method, key string, query url.Values, body []byte) ([]byte, error) {
+	req, err := s.newRequest(ctx, method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, responseError(resp.StatusCode, data)
+	}
+	return data, nil
+}
+
+func (s *Store) newRequest(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	objectPath := ""
+	if key != "" {
+		objectPath = path.Join(s.config.Prefix, key)
+	}
+
+	if s.config.PathStyle {
+		objectPath = path.Join(s.config.Bucket, objectPath)
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = "/" + objectPath
+	u.RawPath = "/" + uriEncode(objectPath, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = int64(len(body))
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		payloadHash = hashHex(body)
+	}
+	s.signer.sign(req, payloadHash, time.Now())
+	return req, nil
+}
+
+// responseError returns the error described by an S3 error document, or nil if body is something
+// else and statusCode is a success
+func responseError(statusCode int, body []byte) error {
+	e := &Error{StatusCode: statusCode}
+	if bytes.Contains(body, []byte("<Error>")) && xml.Unmarshal(body, e) == nil {
+		return e
+	}
+	if statusCode >= 200 && statusCode <= 299 {
+		return nil
+	}
+	e.Message = strings.TrimSpace(string(body))
+	return e
+}
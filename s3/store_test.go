@@ -0,0 +1,282 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a stand-in for an S3-compatible service with path-style addressing. It checks the
+// signature of every request and supports the calls Store makes.
+type fakeS3 struct {
+	t      *testing.T
+	signer signer
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	aborted []string
+	// failPart, if set, makes uploading that part number fail
+	failPart int
+	nextID   int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *Store) {
+	t.Helper()
+	config := Config{
+		Region:          "us-east-1",
+		Bucket:          "media",
+		Prefix:          "bot",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	}
+
+	fake := &fakeS3{
+		t:       t,
+		signer:  signer{accessKeyID: config.AccessKeyID, secretAccessKey: config.SecretAccessKey, region: config.Region},
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	config.Endpoint = server.URL
+	store, err := NewStore(config, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, store
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := f.verify(r, body); err != nil {
+		f.t.Errorf("%s %s: %v", r.Method, r.URL, err)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>%s</Message></Error>", err)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/media/")
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodHead && r.URL.Path == "/media":
+	case r.Method == http.MethodPut && uploadID == "":
+		f.objects[key] = body
+	case r.Method == http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			return
+		}
+		w.Write(object)
+	case r.Method == http.MethodDelete && uploadID == "":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut:
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if number == f.failPart {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "<Error><Code>InternalError</Code><Message>We encountered an internal error.</Message></Error>")
+			return
+		}
+		f.uploads[uploadID][number] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+	case r.Method == http.MethodPost:
+		f.complete(w, key, uploadID, body)
+	case r.Method == http.MethodDelete:
+		delete(f.uploads, uploadID)
+		f.aborted = append(f.aborted, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, key, uploadID string, body []byte) {
+	var request struct {
+		Parts []completedPart `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	parts := f.uploads[uploadID]
+	sort.Slice(request.Parts, func(i, j int) bool { return request.Parts[i].PartNumber < request.Parts[j].PartNumber })
+	var object []byte
+	for _, part := range request.Parts {
+		if part.ETag != fmt.Sprintf(`"etag-%d"`, part.PartNumber) {
+			fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>One or more of the specified parts could not be found.</Message></Error>")
+			return
+		}
+		object = append(object, parts[part.PartNumber]...)
+	}
+
+	f.objects[key] = object
+	delete(f.uploads, uploadID)
+	fmt.Fprint(w, "<CompleteMultipartUploadResult><Key>"+key+"</Key></CompleteMultipartUploadResult>")
+}
+
+// verify signs a copy of r as the store should have and compares the result
+func (f *fakeS3) verify(r *http.Request, body []byte) error {
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+	if want := hashHex(body); payloadHash != want {
+		return fmt.Errorf("payload hash %s, body hashes to %s", payloadHash, want)
+	}
+	signed, err := time.Parse("20060102T150405Z", r.Header.Get("x-amz-date"))
+	if err != nil {
+		return err
+	}
+
+	u := *r.URL
+	u.Host = r.Host
+	expected := &http.Request{Method: r.Method, URL: &u, Header: make(http.Header)}
+	f.signer.sign(expected, payloadHash, signed)
+	if got, want := r.Header.Get("Authorization"), expected.Header.Get("Authorization"); got != want {
+		return fmt.Errorf("Authorization %q, want %q", got, want)
+	}
+	return nil
+}
+
+// state returns the number of multipart uploads started and whether key is stored
+func (f *fakeS3) state(key string) (started int, stored bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, stored = f.objects[key]
+	return f.nextID, stored
+}
+
+func readObject(t *testing.T, store *Store, key string) []byte {
+	t.Helper()
+	object, err := store.Open(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	fake, store := newFakeS3(t)
+
+	if err := store.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		size    int
+		uploads int
+	}{
+		{"empty", 0, 0},
+		{"voice note", 12 << 10, 0},
+		{"one part less a byte", partSize - 1, 0},
+		{"exactly one part", partSize, 1},
+		{"several parts", 2*partSize + 1234, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte("0123456789abcdef"), tt.size/16+1)[:tt.size]
+			key := "documents/1_user/" + strings.ReplaceAll(tt.name, " ", "_") + ".bin"
+			started, _ := fake.state("")
+
+			n, err := store.Put(ctx, key, bytes.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(tt.size) {
+				t.Errorf("Put stored %d bytes, want %d", n, tt.size)
+			}
+			uploads, stored := fake.state("bot/" + key)
+			if got := uploads - started; got != tt.uploads {
+				t.Errorf("%d multipart uploads, want %d", got, tt.uploads)
+			}
+			if !stored {
+				t.Errorf("object not stored under the prefix")
+			}
+			if got := readObject(t, store, key); !bytes.Equal(got, content) {
+				t.Errorf("read back %d bytes that differ from the %d stored", len(got), len(content))
+			}
+		})
+	}
+}
+
+func TestStoreDelete(t *testing.T) {
+	ctx := context.Background()
+	_, store := newFakeS3(t)
+
+	key := "voices/1_user/1700000000_5.ogg"
+	if _, err := store.Put(ctx, key, strings.NewReader("voice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Open(ctx, key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open after Delete returned %v, want os.ErrNotExist", err)
+	}
+	// Deleting a missing object is not an error, as with S3
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("deleting a missing object: %v", err)
+	}
+}
+
+func TestStoreAbortsFailedUpload(t *testing.T) {
+	ctx := context.Background()
+	fake, store := newFakeS3(t)
+	fake.failPart = 2
+
+	key := "videos/1_user/1700000000_5_clip.mp4"
+	content := bytes.Repeat([]byte{1}, 2*partSize+1)
+	_, err := store.Put(ctx, key, bytes.NewReader(content))
+
+	var s3Err *Error
+	if !errors.As(err, &s3Err) || s3Err.Code != "InternalError" {
+		t.Fatalf("Put returned %v, want the service's error", err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.aborted) != 1 || len(fake.uploads) != 0 {
+		t.Errorf("upload not aborted: aborted %v, still open %d", fake.aborted, len(fake.uploads))
+	}
+	if _, ok := fake.objects["bot/"+key]; ok {
+		t.Error("failed upload left an object behind")
+	}
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"telegram-message-receiver/metrics"
+)
+
+// errBlobNotFound is returned when no content is stored for a Telegram file unique ID
+var errBlobNotFound = errors.New("no content stored for file")
+
+// blobStore keeps file contents under dir named by their SHA-256 checksum, so identical files
+// are stored once however many messages carry them. Each blob has a record counting the
+// messages that reference it, and the Telegram file unique IDs it was received as are mapped
+// to it so a repeat can be recognised before it is downloaded.
+//
+// Layout: <sha[:2]>/<sha> holds the content, <sha[:2]>/<sha>.json its record and
+// ids/<file unique ID> the checksum of the content stored for that ID.
+type blobStore struct {
+	dir   string
+	locks *pathLocks
+}
+
+// blobRecord describes a stored blob
+type blobRecord struct {
+	SHA256        string   `json:"sha256"`
+	Size          int64    `json:"size"`
+	FileName      string   `json:"file_name"`
+	FileUniqueIDs []string `json:"file_unique_ids,omitempty"`
+	// Refs is the number of messages referencing the blob; it is deleted when this drops to zero
+	Refs int `json:"refs"`
+}
+
+func newBlobStore(dir string, locks *pathLocks) *blobStore {
+	return &blobStore{dir: dir, locks: locks}
+}
+
+// put stores the content of reader, unless identical content is stored already, and takes a
+// reference to it. fileUniqueID, if set, is mapped to the blob.
+func (b *blobStore) put(ctx context.Context, reader io.Reader, fileName, fileUniqueID string) (blobRecord, error) {
+	if err := os.MkdirAll(b.dir, os.ModePerm); err != nil {
+		return blobRecord{}, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(b.dir, ".tmp-*")
+	if err != nil {
+		return blobRecord{}, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(tmp, contextReader{ctx: ctx, reader: io.TeeReader(reader, hash)})
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		return blobRecord{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return blobRecord{}, err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	unlock := b.locks.lock(b.recordPath(checksum))
+	defer unlock()
+
+	record, err := b.readRecord(checksum)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err := os.MkdirAll(filepath.Dir(b.contentPath(checksum)), os.ModePerm); err != nil {
+			return blobRecord{}, fmt.Errorf("failed to create directory: %w", err)
+		}
+		if err := os.Rename(tmp.Name(), b.contentPath(checksum)); err != nil {
+			return blobRecord{}, fmt.Errorf("failed to store content: %w", err)
+		}
+		record = blobRecord{SHA256: checksum, Size: size, FileName: fileName}
+	case err != nil:
+		return blobRecord{}, err
+	default:
+		metrics.MediaDeduplicated.Inc()
+	}
+
+	if fileUniqueID != "" {
+		if err := b.mapID(&record, fileUniqueID); err != nil {
+			return blobRecord{}, err
+		}
+	}
+
+	record.Refs++
+	if err := b.writeRecord(record); err != nil {
+		return blobRecord{}, err
+	}
+	return record, nil
+}
+
+// acquire takes a reference to the blob stored for fileUniqueID, or returns errBlobNotFound
+func (b *blobStore) acquire(fileUniqueID string) (blobRecord, error) {
+	data, err := os.ReadFile(b.idPath(fileUniqueID))
+	if errors.Is(err, os.ErrNotExist) {
+		return blobRecord{}, errBlobNotFound
+	}
+	if err != nil {
+		return blobRecord{}, fmt.Errorf("failed to read file ID mapping: %w", err)
+	}
+	checksum := strings.TrimSpace(string(data))
+
+	unlock := b.locks.lock(b.recordPath(checksum))
+	defer unlock()
+
+	record, err := b.readRecord(checksum)
+	if errors.Is(err, os.ErrNotExist) {
+		// Released since the mapping was read
+		return blobRecord{}, errBlobNotFound
+	}
+	if err != nil {
+		return blobRecord{}, err
+	}
+
+	record.Refs++
+	if err := b.writeRecord(record); err != nil {
+		return blobRecord{}, err
+	}
+	metrics.MediaDeduplicated.Inc()
+	return record, nil
+}
+
+// release drops a reference to a blob, deleting the blob and its file ID mappings with the last one
+func (b *blobStore) release(checksum string) error {
+	unlock := b.locks.lock(b.recordPath(checksum))
+	defer unlock()
+
+	record, err := b.readRecord(checksum)
+	if err != nil {
+		return err
+	}
+
+	record.Refs--
+	if record.Refs > 0 {
+		return b.writeRecord(record)
+	}
+
+	for _, id := range record.FileUniqueIDs {
+		if err := os.Remove(b.idPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove file ID mapping: %w", err)
+		}
+	}
+	if err := os.Remove(b.contentPath(checksum)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove content: %w", err)
+	}
+	if err := os.Remove(b.recordPath(checksum)); err != nil {
+		return fmt.Errorf("failed to remove blob record: %w", err)
+	}
+	return nil
+}
+
+// link makes the content of a blob available at path, adding a numeric suffix if a file
+// already exists there, and returns the path used. The file is a hard link to the blob where
+// the file system allows it and a copy otherwise.
+func (b *blobStore) link(checksum, path string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	candidate := path
+	for i := 1; ; i++ {
+		err := os.Link(b.contentPath(checksum), candidate)
+		if err == nil {
+			return candidate, nil
+		}
+		if errors.Is(err, os.ErrExist) {
+			candidate = fmt.Sprintf("%s_%d%s", base, i, ext)
+			continue
+		}
+		return b.copy(checksum, path)
+	}
+}
+
+func (b *blobStore) copy(checksum, path string) (string, error) {
+	content, err := os.Open(b.contentPath(checksum))
+	if err != nil {
+		return "", fmt.Errorf("failed to open content: %w", err)
+	}
+	defer content.Close()
+
+	file, filePath, err := createUnique(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	if err := copyAndSync(context.Background(), file, content); err != nil {
+		file.Close()
+		os.Remove(filePath)
+		return "", fmt.Errorf("failed to copy content: %w", err)
+	}
+	return filePath, nil
+}
+
+// mapID records that fileUniqueID was received as the content of record
+func (b *blobStore) mapID(record *blobRecord, fileUniqueID string) error {
+	for _, id := range record.FileUniqueIDs {
+		if id == fileUniqueID {
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(b.dir, "ids"), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := writeFileAtomic(b.idPath(fileUniqueID), []byte(record.SHA256)); err != nil {
+		return fmt.Errorf("failed to save file ID mapping: %w", err)
+	}
+	record.FileUniqueIDs = append(record.FileUniqueIDs, fileUniqueID)
+	return nil
+}
+
+func (b *blobStore) readRecord(checksum string) (blobRecord, error) {
+	var record blobRecord
+
+	data, err := os.ReadFile(b.recordPath(checksum))
+	if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, fmt.Errorf("failed to decode blob record: %w", err)
+	}
+	return record, nil
+}
+
+func (b *blobStore) writeRecord(record blobRecord) error {
+	if err := writeJSONAtomic(b.recordPath(record.SHA256), record); err != nil {
+		return fmt.Errorf("failed to save blob record: %w", err)
+	}
+	return nil
+}
+
+func (b *blobStore) contentPath(checksum string) string {
+	return filepath.Join(b.dir, checksum[:2], checksum)
+}
+
+func (b *blobStore) recordPath(checksum string) string {
+	return b.contentPath(checksum) + ".json"
+}
+
+func (b *blobStore) idPath(fileUniqueID string) string {
+	return filepath.Join(b.dir, "ids", sanitizeFileName(fileUniqueID))
+}
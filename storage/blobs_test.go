@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlobRefcount(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// puts and acquires take references to the same content, released again one by one
+		puts     int
+		acquires int
+	}{
+		{"single message", 1, 0},
+		{"same content twice", 2, 0},
+		{"recognised by file ID", 1, 2},
+		{"both", 2, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBlobStore(t.TempDir(), newPathLocks())
+
+			var record blobRecord
+			for i := 0; i < tt.puts; i++ {
+				var err error
+				record, err = b.put(ctx, strings.NewReader("content"), "file.txt", "unique")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.acquires; i++ {
+				var err error
+				if record, err = b.acquire("unique"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			refs := tt.puts + tt.acquires
+			if record.Refs != refs {
+				t.Fatalf("%d refs, want %d", record.Refs, refs)
+			}
+
+			for i := refs; i > 0; i-- {
+				if _, err := os.Stat(b.contentPath(record.SHA256)); err != nil {
+					t.Fatalf("content gone with %d refs left: %v", i, err)
+				}
+				if err := b.release(record.SHA256); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, path := range []string{b.contentPath(record.SHA256), b.recordPath(record.SHA256), b.idPath("unique")} {
+				if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("%s left after the last release: %v", path, err)
+				}
+			}
+			if _, err := b.acquire("unique"); !errors.Is(err, errBlobNotFound) {
+				t.Errorf("acquire after the last release returned %v, want errBlobNotFound", err)
+			}
+		})
+	}
+}
+
+func TestBlobPutDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	b := newBlobStore(t.TempDir(), newPathLocks())
+
+	first, err := b.put(ctx, strings.NewReader("same"), "a.txt", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.put(ctx, strings.NewReader("same"), "b.txt", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := b.put(ctx, strings.NewReader("different"), "c.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.SHA256 != second.SHA256 || second.Refs != 2 {
+		t.Errorf("identical content stored as %s and %s with %d refs", first.SHA256, second.SHA256, second.Refs)
+	}
+	if other.SHA256 == first.SHA256 || other.Refs != 1 {
+		t.Errorf("different content shares %s, %d refs", other.SHA256, other.Refs)
+	}
+	// Both file IDs now lead to the shared content
+	if record, err := b.acquire("second"); err != nil || record.SHA256 != first.SHA256 {
+		t.Errorf("acquire(second) = %s, %v", record.SHA256, err)
+	}
+}
+
+func TestBlobLink(t *testing.T) {
+	dir := t.TempDir()
+	b := newBlobStore(filepath.Join(dir, "blobs"), newPathLocks())
+	record, err := b.put(context.Background(), strings.NewReader("content"), "scan.pdf", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.Stat(b.contentPath(record.SHA256))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "documents", "1_user", "scan.pdf")
+	want := []string{
+		path,
+		filepath.Join(dir, "documents", "1_user", "scan_1.pdf"),
+		filepath.Join(dir, "documents", "1_user", "scan_2.pdf"),
+	}
+	for _, w := range want {
+		got, err := b.link(record.SHA256, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != w {
+			t.Errorf("linked to %s, want %s", got, w)
+		}
+		linked, err := os.Stat(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(content, linked) {
+			t.Errorf("%s is not a hard link to the blob", got)
+		}
+	}
+}
+
+func TestLocalDeleteSharedMedia(t *testing.T) {
+	ctx := context.Background()
+	s := NewLocalStorage(t.TempDir(), newTestLogger(t))
+
+	photo := func(messageID int) MediaInfo {
+		return MediaInfo{
+			MessageInfo:  MessageInfo{MessageID: messageID, ChatID: 1, UserID: 1, Username: "user", Timestamp: time.Unix(1700000000, 0)},
+			Kind:         MediaPhoto,
+			FileName:     "photo.jpg",
+			FileUniqueID: "unique",
+		}
+	}
+
+	if err := s.SaveMediaFile(ctx, photo(1), strings.NewReader("pixels")); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := s.SaveMediaReference(ctx, photo(2)); err != nil || !stored {
+		t.Fatalf("SaveMediaReference = %v, %v", stored, err)
+	}
+
+	if err := s.DeleteMedia(ctx, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetMedia(ctx, 1, 1); err == nil {
+		t.Error("deleted media still readable")
+	}
+	if got := readMedia(t, s, 1, 2); got != "pixels" {
+		t.Errorf("message 2 reads %q after message 1 was deleted", got)
+	}
+
+	if err := s.DeleteMedia(ctx, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteMedia(ctx, 1, 2); !errors.Is(err, ErrMediaNotFound) {
+		t.Errorf("second DeleteMedia returned %v, want ErrMediaNotFound", err)
+	}
+	// The content went with its last reference
+	if _, err := s.blobs.acquire("unique"); !errors.Is(err, errBlobNotFound) {
+		t.Errorf("acquire after deleting every message returned %v, want errBlobNotFound", err)
+	}
+}
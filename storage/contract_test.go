@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBackend opens an empty storage of one backend for a test
+type testBackend struct {
+	name string
+	open func(t *testing.T) MessageStorage
+}
+
+var testBackends = []testBackend{
+	{"local", func(t *testing.T) MessageStorage { return NewLocalStorage(t.TempDir(), newTestLogger(t)) }},
+	{"sqlite", func(t *testing.T) MessageStorage { return newTestSQLite(t) }},
+	// Skipped unless TEST_POSTGRES_DSN names a database to create test schemas in
+	{"postgres", func(t *testing.T) MessageStorage { return newTestPostgres(t) }},
+}
+
+// forEachBackend runs test against an empty storage of every backend
+func forEachBackend(t *testing.T, test func(t *testing.T, s MessageStorage)) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.open(t))
+		})
+	}
+}
+
+func testInfo(chatID int64, messageID int) MessageInfo {
+	return MessageInfo{MessageID: messageID, ChatID: chatID, UserID: chatID, Username: "user", Timestamp: time.Unix(1700000000, 0)}
+}
+
+func TestStorageSaveText(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		ctx := context.Background()
+		message := TextMessage{MessageInfo: testInfo(1, 10), Text: "hello"}
+
+		if err := s.SaveTextMessage(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+		if stored, err := s.HasMessage(ctx, 1, 10); err != nil || !stored {
+			t.Errorf("HasMessage(1, 10) = %v, %v after saving it", stored, err)
+		}
+		if stored, err := s.HasMessage(ctx, 1, 11); err != nil || stored {
+			t.Errorf("HasMessage(1, 11) = %v, %v for a message never saved", stored, err)
+		}
+
+		// A replayed update keeps the stored copy
+		replay := message
+		replay.Text = "changed"
+		if err := s.SaveTextMessage(ctx, replay); !errors.Is(err, ErrDuplicateMessage) {
+			t.Errorf("saving message 10 again returned %v, want ErrDuplicateMessage", err)
+		}
+
+		messages, err := s.ListMessages(ctx, MessageFilter{ChatID: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 || messages[0].Text != "hello" || messages[0].MessageID != 10 {
+			t.Errorf("stored messages %+v, want message 10 once", messages)
+		}
+	})
+}
+
+func TestStorageSaveMedia(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		ctx := context.Background()
+		media := MediaInfo{MessageInfo: testInfo(1, 10), Kind: MediaDocument, FileName: "scan.pdf", FileUniqueID: "unique"}
+
+		if err := s.SaveMediaFile(ctx, media, strings.NewReader("content")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveMediaFile(ctx, media, strings.NewReader("replayed")); !errors.Is(err, ErrDuplicateMessage) {
+			t.Errorf("saving message 10 again returned %v, want ErrDuplicateMessage", err)
+		}
+		if got := readMedia(t, s, 1, 10); got != "content" {
+			t.Errorf("message 10 reads %q, want the first content", got)
+		}
+		if got := mediaFileName(t, s, 1, 10); got != "scan.pdf" {
+			t.Errorf("message 10 is named %q, want scan.pdf", got)
+		}
+
+		// The same file sent again is stored without downloading it, under the name it's sent with
+		media.MessageInfo, media.FileName = testInfo(1, 11), "other.pdf"
+		if stored, err := s.SaveMediaReference(ctx, media); err != nil || !stored {
+			t.Fatalf("SaveMediaReference = %v, %v", stored, err)
+		}
+		if got := readMedia(t, s, 1, 11); got != "content" {
+			t.Errorf("message 11 reads %q, want the shared content", got)
+		}
+		if got := mediaFileName(t, s, 1, 11); got != "other.pdf" {
+			t.Errorf("message 11 is named %q, want other.pdf", got)
+		}
+
+		media.MessageInfo, media.FileUniqueID = testInfo(1, 12), "other"
+		if stored, err := s.SaveMediaReference(ctx, media); err != nil || stored {
+			t.Errorf("SaveMediaReference of unknown content = %v, %v, want false", stored, err)
+		}
+	})
+}
+
+// A message delivered to several workers or instances at once is stored by exactly one
+func TestStorageConcurrentDuplicates(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		ctx := context.Background()
+		message := TextMessage{MessageInfo: testInfo(1, 10), Text: "hello"}
+
+		const writers = 8
+		errs := make(chan error, writers)
+		for i := 0; i < writers; i++ {
+			go func() { errs <- s.SaveTextMessage(ctx, message) }()
+		}
+
+		saved := 0
+		for i := 0; i < writers; i++ {
+			switch err := <-errs; {
+			case err == nil:
+				saved++
+			case !errors.Is(err, ErrDuplicateMessage):
+				t.Errorf("concurrent save returned %v", err)
+			}
+		}
+		if saved != 1 {
+			t.Errorf("message saved %d times, want once", saved)
+		}
+
+		messages, err := s.ListMessages(ctx, MessageFilter{ChatID: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 {
+			t.Errorf("stored %d messages, want 1", len(messages))
+		}
+	})
+}
+
+// References to stored content saved while messages sharing it are deleted either find the
+// content, which then stays readable, or report that there is none
+func TestStorageConcurrentReferences(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		ctx := context.Background()
+		media := MediaInfo{MessageInfo: testInfo(1, 10), Kind: MediaDocument, FileName: "scan.pdf", FileUniqueID: "unique"}
+		if err := s.SaveMediaFile(ctx, media, strings.NewReader("content")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Messages 11 to 18 refer to the content while 10 to 14 are deleted
+		const references, deletes = 8, 5
+		var (
+			wg     sync.WaitGroup
+			mu     sync.Mutex
+			stored = map[int]bool{}
+		)
+		for i := 0; i < references; i++ {
+			wg.Add(1)
+			go func(info MediaInfo) {
+				defer wg.Done()
+				ok, err := s.SaveMediaReference(ctx, info)
+				if err != nil {
+					t.Errorf("SaveMediaReference of message %d: %v", info.MessageID, err)
+				}
+				mu.Lock()
+				stored[info.MessageID] = ok
+				mu.Unlock()
+			}(MediaInfo{MessageInfo: testInfo(1, 11+i), Kind: MediaDocument, FileUniqueID: "unique"})
+		}
+		for i := 0; i < deletes; i++ {
+			wg.Add(1)
+			go func(messageID int) {
+				defer wg.Done()
+				if err := s.DeleteMedia(ctx, 1, messageID); err != nil && !errors.Is(err, ErrMediaNotFound) {
+					t.Errorf("DeleteMedia of message %d: %v", messageID, err)
+				}
+			}(10 + i)
+		}
+		wg.Wait()
+
+		// The references that weren't deleted
+		for messageID := 10 + deletes; messageID <= 10+references; messageID++ {
+			if !stored[messageID] {
+				continue
+			}
+			if got := readMedia(t, s, 1, messageID); got != "content" {
+				t.Errorf("message %d reads %q, want the shared content", messageID, got)
+			}
+		}
+	})
+}
+
+func TestStorageRecordMessage(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		ctx := context.Background()
+
+		if err := s.RecordMessage(ctx, 1, 10); err != nil {
+			t.Fatal(err)
+		}
+		if stored, err := s.HasMessage(ctx, 1, 10); err != nil || !stored {
+			t.Errorf("HasMessage(1, 10) = %v, %v after recording it", stored, err)
+		}
+		if err := s.RecordMessage(ctx, 1, 10); !errors.Is(err, ErrDuplicateMessage) {
+			t.Errorf("recording message 10 again returned %v, want ErrDuplicateMessage", err)
+		}
+		if err := s.RecordMessage(ctx, 2, 10); err != nil {
+			t.Errorf("recording message 10 of another chat returned %v", err)
+		}
+	})
+}
+
+func TestStorageContactInfo(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		ctx := context.Background()
+		sent := time.Unix(1700000000, 0)
+
+		if has, err := s.HasContactInfo(ctx, 1); err != nil || has {
+			t.Fatalf("HasContactInfo before sharing = %v, %v", has, err)
+		}
+		if err := s.SaveContactInfo(ctx, 1, "user", "+100", sent); err != nil {
+			t.Fatal(err)
+		}
+		if has, err := s.HasContactInfo(ctx, 1); err != nil || !has {
+			t.Errorf("HasContactInfo after sharing = %v, %v", has, err)
+		}
+		if has, err := s.HasContactInfo(ctx, 2); err != nil || has {
+			t.Errorf("HasContactInfo of another chat = %v, %v", has, err)
+		}
+
+		// Sharing again replaces the number
+		if err := s.SaveContactInfo(ctx, 1, "user", "+200", sent.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		contact, err := s.GetContact(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contact.PhoneNumber != "+200" || contact.Username != "user" {
+			t.Errorf("GetContact = %+v, want the latest number", contact)
+		}
+		if _, err := s.GetContact(ctx, 2); !errors.Is(err, ErrContactNotFound) {
+			t.Errorf("GetContact of another chat returned %v, want ErrContactNotFound", err)
+		}
+	})
+}
+
+func TestStorageUpdateOffset(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		ctx := context.Background()
+
+		if offset, err := s.LoadUpdateOffset(ctx); err != nil || offset != 0 {
+			t.Fatalf("LoadUpdateOffset before saving = %d, %v, want 0", offset, err)
+		}
+		for _, want := range []int{42, 43, 7} {
+			if err := s.SaveUpdateOffset(ctx, want); err != nil {
+				t.Fatal(err)
+			}
+			if offset, err := s.LoadUpdateOffset(ctx); err != nil || offset != want {
+				t.Errorf("LoadUpdateOffset = %d, %v, want %d", offset, err, want)
+			}
+		}
+	})
+}
+
+func TestStorageCheck(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		if err := s.Check(context.Background()); err != nil {
+			t.Errorf("Check = %v", err)
+		}
+	})
+}
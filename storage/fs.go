@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// pathLocks serializes writers of the same file while letting different files be written concurrently
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newPathLocks() *pathLocks {
+	return &pathLocks{locks: make(map[string]*pathLock)}
+}
+
+// lock acquires the lock for path and returns the function that releases it
+func (p *pathLocks) lock(path string) func() {
+	p.mu.Lock()
+	l, ok := p.locks[path]
+	if !ok {
+		l = &pathLock{}
+		p.locks[path] = l
+	}
+	l.refs++
+	p.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		p.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(p.locks, path)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// createUnique creates a new file at path, adding a numeric suffix if a file already exists
+// there, so concurrent writers never overwrite each other. It returns the file and its path.
+func createUnique(path string) (*os.File, string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	candidate := path
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(candidate, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return file, candidate, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, "", err
+		}
+		candidate = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+}
+
+// contextReader stops reading once its context is done, so cancellation interrupts long copies
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// copyAndSync copies reader into file and flushes it to disk
+func copyAndSync(ctx context.Context, file *os.File, reader io.Reader) error {
+	if _, err := io.Copy(file, contextReader{ctx: ctx, reader: reader}); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// writeFile streams reader into a new file at path, removing it again if the copy fails
+func writeFile(ctx context.Context, path string, reader io.Reader) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	n, err := io.Copy(file, contextReader{ctx: ctx, reader: reader})
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	return n, nil
+}
+
+// writeFileAtomic replaces the file at path with data so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeJSONAtomic replaces the file at path with v as indented JSON
+func writeJSONAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	return writeFileAtomic(path, data)
+}
+
+// appendJSONLine appends v as a single line of JSON to the file at filePath and flushes it to disk
+func appendJSONLine(filePath string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+
+	// A single write keeps the record on one line
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sanitizeFileName strips any directory components and path separators from a user supplied file name
+func sanitizeFileName(fileName string) string {
+	fileName = filepath.Base(strings.ReplaceAll(fileName, "\\", "/"))
+	if fileName == "." || fileName == "/" || fileName == ".." {
+		return "file"
+	}
+	return fileName
+}
+
+// derivedFiles returns the files next to path that share its name but not its extension,
+// e.g. the sidecar and transcript of a voice recording
+func derivedFiles(path string) ([]string, error) {
+	prefix := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) + "."
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", filepath.Dir(path), err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, prefix) && name != filepath.Base(path) {
+			files = append(files, filepath.Join(filepath.Dir(path), name))
+		}
+	}
+	return files, nil
+}
+
+// checkWritable creates and removes a temporary file in dir to verify it can be written to
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	file.Close()
+
+	if err := os.Remove(file.Name()); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", file.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ErrDuplicateMessage is returned when a message with the same chat and message ID was already stored
+var ErrDuplicateMessage = errors.New("message already stored")
+
+// ErrMediaNotFound is returned when deleting the attachment of a message that has none stored
+var ErrMediaNotFound = errors.New("media not found")
+
+// ErrContactNotFound is returned when looking up the contact of a user who hasn't shared one
+var ErrContactNotFound = errors.New("contact not found")
+
+// messageIndex records which message IDs LocalStorage has stored for each chat, one
+// index/<chatID> file per chat with a message ID per line. Chats are loaded lazily.
+type messageIndex struct {
+	dir   string
+	mu    sync.Mutex
+	chats map[int64]map[int]struct{}
+}
+
+func newMessageIndex(dir string) *messageIndex {
+	return &messageIndex{
+		dir:   dir,
+		chats: make(map[int64]map[int]struct{}),
+	}
+}
+
+func (i *messageIndex) path(chatID int64) string {
+	return filepath.Join(i.dir, strconv.FormatInt(chatID, 10))
+}
+
+func (i *messageIndex) has(chatID int64, messageID int) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	ids, err := i.load(chatID)
+	if err != nil {
+		return false, err
+	}
+	_, ok := ids[messageID]
+	return ok, nil
+}
+
+func (i *messageIndex) add(chatID int64, messageID int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	ids, err := i.load(chatID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(i.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := os.OpenFile(i.path(chatID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open message index: %w", err)
+	}
+
+	_, err = file.WriteString(strconv.Itoa(messageID) + "\n")
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update message index: %w", err)
+	}
+
+	ids[messageID] = struct{}{}
+	return nil
+}
+
+// remove takes messageID out of the index again by rewriting the chat's file without it
+func (i *messageIndex) remove(chatID int64, messageID int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	ids, err := i.load(chatID)
+	if err != nil {
+		return err
+	}
+	if _, ok := ids[messageID]; !ok {
+		return nil
+	}
+
+	remaining := make([]int, 0, len(ids)-1)
+	for id := range ids {
+		if id != messageID {
+			remaining = append(remaining, id)
+		}
+	}
+	sort.Ints(remaining)
+	var data []byte
+	for _, id := range remaining {
+		data = strconv.AppendInt(data, int64(id), 10)
+		data = append(data, '\n')
+	}
+	if err := writeFileAtomic(i.path(chatID), data); err != nil {
+		return fmt.Errorf("failed to update message index: %w", err)
+	}
+
+	delete(ids, messageID)
+	return nil
+}
+
+// load returns the cached IDs for chatID, reading them from disk on first use. i.mu must be held.
+func (i *messageIndex) load(chatID int64) (map[int]struct{}, error) {
+	if ids, ok := i.chats[chatID]; ok {
+		return ids, nil
+	}
+
+	ids := make(map[int]struct{})
+	file, err := os.Open(i.path(chatID))
+	if errors.Is(err, os.ErrNotExist) {
+		i.chats[chatID] = ids
+		return ids, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message index: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// A torn last line from a crash is skipped rather than failing the whole chat
+		if id, err := strconv.Atoi(scanner.Text()); err == nil {
+			ids[id] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read message index: %w", err)
+	}
+
+	i.chats[chatID] = ids
+	return ids, nil
+}
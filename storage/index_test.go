@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// A message is indexed before it is saved, so it is never saved without being indexed, and
+// taken out of the index again if the save fails so its replay is stored
+func TestLocalRecordMessageIndexFirst(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := NewLocalStorage(dir, newTestLogger(t))
+	media := MediaInfo{MessageInfo: testInfo(1, 10), Kind: MediaDocument, FileName: "scan.pdf"}
+
+	errRead := errors.New("connection reset")
+	if err := s.SaveMediaFile(ctx, media, iotest.ErrReader(errRead)); !errors.Is(err, errRead) {
+		t.Fatalf("SaveMediaFile of a failing download = %v, want the read error", err)
+	}
+	if seen, err := s.HasMessage(ctx, 1, 10); err != nil || seen {
+		t.Errorf("HasMessage(1, 10) = %v, %v after the failed save, want false", seen, err)
+	}
+	if err := s.SaveMediaFile(ctx, media, strings.NewReader("content")); err != nil {
+		t.Fatalf("saving the replayed message: %v", err)
+	}
+	if got := readMedia(t, s, 1, 10); got != "content" {
+		t.Errorf("message 10 reads %q, want the replayed content", got)
+	}
+
+	// Nothing is saved for a message that can't be indexed
+	if _, err := s.HasMessage(ctx, 2, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "index", "2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveTextMessage(ctx, TextMessage{MessageInfo: testInfo(2, 20), Text: "hello"}); err == nil {
+		t.Fatal("SaveTextMessage succeeded without updating the index")
+	}
+	if messages, err := s.ListMessages(ctx, MessageFilter{ChatID: 2}); err != nil || len(messages) != 0 {
+		t.Errorf("ListMessages = %+v, %v, want nothing stored", messages, err)
+	}
+}
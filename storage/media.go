@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// MediaStore holds the content of media files for SQLStorage. Keys are slash separated
+// relative paths such as "voices/<chatID>_<username>/<name>.ogg".
+type MediaStore interface {
+	// Put streams reader into the content stored under key, replacing any stored before, and
+	// returns the number of bytes stored
+	Put(ctx context.Context, key string, reader io.Reader) (int64, error)
+	// Open returns the content stored under key, or an error matching os.ErrNotExist
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the content stored under key; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// Check returns an error if content can't currently be stored
+	Check(ctx context.Context) error
+}
+
+// FileMediaStore keeps media content as files under a directory
+type FileMediaStore struct {
+	dir string
+}
+
+func NewFileMediaStore(dir string) *FileMediaStore {
+	return &FileMediaStore{dir: dir}
+}
+
+func (f *FileMediaStore) Put(ctx context.Context, key string, reader io.Reader) (int64, error) {
+	return writeFile(ctx, f.path(key), reader)
+}
+
+func (f *FileMediaStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(f.path(key))
+}
+
+func (f *FileMediaStore) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(f.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Check verifies that files can be created under the directory
+func (f *FileMediaStore) Check(ctx context.Context) error {
+	return checkWritable(f.dir)
+}
+
+func (f *FileMediaStore) path(key string) string {
+	return filepath.Join(f.dir, filepath.FromSlash(key))
+}
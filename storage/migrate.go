@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// legacyUsername is recorded for migrated messages; the old layout never stored who sent them
+const legacyUsername = "unknown"
+
+// legacyEntry matches the "[<RFC3339>]: <text>" lines of the old texts/<unix>.txt files
+var legacyEntry = regexp.MustCompile(`^\[(\d{4}-\d{2}-\d{2}T[^\]]+)\]: (.*)$`)
+
+// MigrateLegacyTexts converts texts/<unix>.txt files written by earlier versions into the
+// per-day JSONL layout. Migrated files are renamed to *.txt.migrated so the tool can be
+// re-run safely. It returns the number of messages migrated.
+//
+// No chat ever has ID 0, so the output folder holds migrated messages only. Each run rewrites
+// its day files from every legacy file, migrated or not, and replaces them atomically, so a run
+// that fails partway leaves nothing to duplicate when it is repeated.
+func MigrateLegacyTexts(basePath string) (int, error) {
+	textFolder := filepath.Join(basePath, "texts")
+	files, err := filepath.Glob(filepath.Join(textFolder, "*.txt"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list legacy text files: %w", err)
+	}
+	if len(files) == 0 {
+		return 0, nil
+	}
+	migrated, err := filepath.Glob(filepath.Join(textFolder, "*.txt.migrated"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list migrated text files: %w", err)
+	}
+
+	days := make(map[string][]TextMessage)
+	total := 0
+	for _, path := range append(migrated, files...) {
+		messages, err := readLegacyTextFile(path)
+		if err != nil {
+			return 0, err
+		}
+		for _, message := range messages {
+			day := message.Timestamp.UTC().Format("2006-01-02")
+			days[day] = append(days[day], message)
+		}
+		if filepath.Ext(path) == ".txt" {
+			total += len(messages)
+		}
+	}
+
+	outFolder := filepath.Join(textFolder, fmt.Sprintf("0_%s", legacyUsername))
+	if err := os.MkdirAll(outFolder, os.ModePerm); err != nil {
+		return 0, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	for day, messages := range days {
+		sort.SliceStable(messages, func(i, j int) bool { return messages[i].Timestamp.Before(messages[j].Timestamp) })
+
+		var data []byte
+		for _, message := range messages {
+			line, err := json.Marshal(message)
+			if err != nil {
+				return 0, fmt.Errorf("failed to marshal record: %w", err)
+			}
+			data = append(append(data, line...), '\n')
+		}
+
+		outPath := filepath.Join(outFolder, day+".jsonl")
+		if err := writeFileAtomic(outPath, data); err != nil {
+			return 0, fmt.Errorf("failed to write %s: %w", outPath, err)
+		}
+	}
+
+	for _, path := range files {
+		if err := os.Rename(path, path+".migrated"); err != nil {
+			return 0, fmt.Errorf("failed to mark %s as migrated: %w", path, err)
+		}
+	}
+
+	return total, nil
+}
+
+func readLegacyTextFile(path string) ([]TextMessage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var messages []TextMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		match := legacyEntry.FindStringSubmatch(line)
+		if match == nil {
+			// Messages containing newlines were written verbatim, so this continues the previous one
+			if len(messages) > 0 {
+				last := &messages[len(messages)-1]
+				last.Text += "\n" + line
+			}
+			continue
+		}
+
+		timestamp, err := time.Parse(time.RFC3339, match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q in %s: %w", match[1], path, err)
+		}
+
+		messages = append(messages, TextMessage{
+			MessageInfo: MessageInfo{
+				Username:  legacyUsername,
+				Timestamp: timestamp,
+			},
+			Text: match[2],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	return messages, nil
+}
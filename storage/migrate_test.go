@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readDayFile returns the messages of a migrated day file
+func readDayFile(t *testing.T, path string) []TextMessage {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var messages []TextMessage
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var message TextMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func TestMigrateLegacyTexts(t *testing.T) {
+	basePath := t.TempDir()
+	textFolder := filepath.Join(basePath, "texts")
+	if err := os.MkdirAll(textFolder, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	legacy := "[2023-11-14T22:13:20Z]: hello\n" +
+		"[2023-11-14T23:00:00Z]: first line\n" +
+		"second line\n" +
+		"\n" +
+		"[2023-11-15T08:00:00+02:00]: next day\n"
+	if err := os.WriteFile(filepath.Join(textFolder, "1700000000.txt"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := MigrateLegacyTexts(basePath)
+	if err != nil || count != 3 {
+		t.Fatalf("MigrateLegacyTexts = %d, %v, want 3 messages", count, err)
+	}
+	if _, err := os.Stat(filepath.Join(textFolder, "1700000000.txt.migrated")); err != nil {
+		t.Errorf("legacy file not marked as migrated: %v", err)
+	}
+
+	outFolder := filepath.Join(textFolder, "0_unknown")
+	want := map[string][]string{
+		"2023-11-14.jsonl": {"hello", "first line\nsecond line\n"},
+		"2023-11-15.jsonl": {"next day"},
+	}
+	check := func() {
+		t.Helper()
+		for name, texts := range want {
+			messages := readDayFile(t, filepath.Join(outFolder, name))
+			if len(messages) != len(texts) {
+				t.Errorf("%s holds %d messages, want %d", name, len(messages), len(texts))
+				continue
+			}
+			for i, message := range messages {
+				if message.Text != texts[i] || message.Username != legacyUsername {
+					t.Errorf("%s message %d = %q from %q, want %q", name, i, message.Text, message.Username, texts[i])
+				}
+			}
+		}
+	}
+	check()
+
+	// Running again migrates nothing and leaves the day files as they were
+	if count, err := MigrateLegacyTexts(basePath); err != nil || count != 0 {
+		t.Errorf("second run = %d, %v, want 0", count, err)
+	}
+	check()
+
+	// A file left behind by an interrupted run is merged without repeating what was migrated
+	if err := os.WriteFile(filepath.Join(textFolder, "1700050000.txt"), []byte("[2023-11-14T22:30:00Z]: late\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := MigrateLegacyTexts(basePath); err != nil || count != 1 {
+		t.Errorf("third run = %d, %v, want 1", count, err)
+	}
+	want["2023-11-14.jsonl"] = []string{"hello", "late", "first line\nsecond line\n"}
+	check()
+}
+
+func TestMigrateLegacyTextsWithoutLegacyFiles(t *testing.T) {
+	basePath := t.TempDir()
+
+	if count, err := MigrateLegacyTexts(basePath); err != nil || count != 0 {
+		t.Fatalf("MigrateLegacyTexts = %d, %v, want 0", count, err)
+	}
+	if _, err := os.Stat(filepath.Join(basePath, "texts")); !os.IsNotExist(err) {
+		t.Errorf("texts folder created with nothing to migrate: %v", err)
+	}
+}
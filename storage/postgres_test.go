@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testPostgresSchema creates an empty schema in the database at TEST_POSTGRES_DSN, dropped
+// again when the test ends, and returns a DSN that uses it. The test is skipped if the
+// variable is unset.
+func testPostgresSchema(t *testing.T) string {
+	t.Helper()
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+
+	token := make([]byte, 6)
+	if _, err := rand.Read(token); err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + hex.EncodeToString(token)
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("failed to drop schema: %v", err)
+		}
+	})
+
+	// URLs pass unknown query parameters on as run-time settings
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+func openTestPostgres(t *testing.T, dsn string) (*SQLStorage, error) {
+	t.Helper()
+	s, err := NewPostgresStorage(dsn, PostgresPool{MaxConns: 4, MaxIdleConns: 4}, NewFileMediaStore(t.TempDir()), newTestLogger(t))
+	if err == nil {
+		t.Cleanup(func() { s.Close() })
+	}
+	return s, err
+}
+
+func newTestPostgres(t *testing.T) *SQLStorage {
+	t.Helper()
+	s, err := openTestPostgres(t, testPostgresSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Instances starting together take turns migrating the database under the advisory lock
+func TestPostgresConcurrentMigrations(t *testing.T) {
+	dsn := testPostgresSchema(t)
+
+	const instances = 4
+	storages := make([]*SQLStorage, instances)
+	errs := make([]error, instances)
+	var wg sync.WaitGroup
+	for i := range storages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			storages[i], errs[i] = openTestPostgres(t, dsn)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("instance %d: %v", i, err)
+		}
+	}
+	var version, applied int
+	if err := storages[0].db.QueryRow(`SELECT MAX(version), COUNT(*) FROM schema_migrations`).Scan(&version, &applied); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(postgresMigrations) || applied != len(postgresMigrations) {
+		t.Errorf("schema at version %d with %d migrations applied, want %d once each", version, applied, len(postgresMigrations))
+	}
+}
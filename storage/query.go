@@ -0,0 +1,653 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMessageLimit is the page size of ListMessages when MessageFilter.Limit isn't set
+const DefaultMessageLimit = 100
+
+// MessageKind is the type of a stored message: text, voice or one of the media kinds
+type MessageKind string
+
+const (
+	KindText  MessageKind = kindText
+	KindVoice MessageKind = kindVoice
+)
+
+// mediaKinds lists every MediaKind, in the order their folders are read
+var mediaKinds = []MediaKind{MediaPhoto, MediaDocument, MediaAudio, MediaVideo, MediaVideoNote}
+
+// Chat is a user the bot has heard from
+type Chat struct {
+	ChatID   int64  `json:"chat_id"`
+	Username string `json:"username"`
+	// PhoneNumber is set once the user has shared their contact
+	PhoneNumber string `json:"phone_number,omitempty"`
+	// LastSeen is when the latest message or contact from the user was received
+	LastSeen time.Time `json:"last_seen"`
+	Blocked  bool      `json:"blocked,omitempty"`
+}
+
+// Message is a stored message as returned by ListMessages
+type Message struct {
+	MessageInfo
+	Kind MessageKind `json:"kind"`
+	// Text is the text of a text message or the caption of a voice message
+	Text string `json:"text,omitempty"`
+	// FileName and Size describe the attachment of voice and media messages
+	FileName string `json:"file_name,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	// Duration is the length of a voice message in seconds
+	Duration   int    `json:"duration,omitempty"`
+	Transcript string `json:"transcript,omitempty"`
+}
+
+// MessageFilter selects messages for ListMessages. Zero fields select everything, so a zero
+// ChatID selects the messages of all chats.
+type MessageFilter struct {
+	ChatID int64
+	// Since and Until bound the receive time; Since is inclusive, Until exclusive
+	Since time.Time
+	Until time.Time
+	Kinds []MessageKind
+	// Search selects text messages and voice transcripts containing it, ignoring case
+	Search string
+	// Limit is the maximum number of messages returned, DefaultMessageLimit if zero or negative,
+	// and Offset the number of matching messages skipped before them, none if negative
+	Limit  int
+	Offset int
+	// NewestFirst reverses the order, so the first page holds the latest messages
+	NewestFirst bool
+}
+
+// matches reports whether a message received at timestamp with the given kind passes the
+// time and kind filters
+func (f MessageFilter) matches(kind MessageKind, timestamp time.Time) bool {
+	if !f.Since.IsZero() && timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !timestamp.Before(f.Until) {
+		return false
+	}
+	return f.matchesKind(kind)
+}
+
+// matchesKind reports whether the kind filter lets messages of kind through
+func (f MessageFilter) matchesKind(kind MessageKind) bool {
+	if len(f.Kinds) == 0 {
+		return true
+	}
+	for _, k := range f.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesSearch reports whether a message contains the search text
+func (f MessageFilter) matchesSearch(message Message) bool {
+	if f.Search == "" {
+		return true
+	}
+	search := strings.ToLower(f.Search)
+	return (message.Kind == KindText && strings.Contains(strings.ToLower(message.Text), search)) ||
+		strings.Contains(strings.ToLower(message.Transcript), search)
+}
+
+func (f MessageFilter) limit() int {
+	if f.Limit <= 0 {
+		return DefaultMessageLimit
+	}
+	return f.Limit
+}
+
+func (f MessageFilter) offset() int {
+	if f.Offset < 0 {
+		return 0
+	}
+	return f.Offset
+}
+
+// Media is the stored attachment of a message. The caller must close it.
+type Media struct {
+	io.ReadCloser
+	Kind     MessageKind
+	FileName string
+	Size     int64
+}
+
+// mediaTypes are the MIME types of attachment extensions the system's table may not know
+var mediaTypes = map[string]string{
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".wav":  "audio/wav",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".mov":  "video/quicktime",
+}
+
+// ContentType returns the MIME type of the attachment judging by its file name
+func (m *Media) ContentType() string {
+	ext := strings.ToLower(filepath.Ext(m.FileName))
+	if contentType, ok := mediaTypes[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// ListChats returns every chat with a stored message or contact, most recently seen first.
+// A chat whose username changed is listed once, under the latest username.
+func (s *LocalStorage) ListChats(ctx context.Context) ([]Chat, error) {
+	chats := make(map[int64]*Chat)
+
+	for _, folder := range s.chatFolders() {
+		entries, err := os.ReadDir(filepath.Join(s.basePath, folder))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", folder, err)
+		}
+
+		for _, entry := range entries {
+			chatID, username, ok := parseChatFolder(entry.Name())
+			if !ok || !entry.IsDir() {
+				continue
+			}
+			lastSeen, err := lastReceived(filepath.Join(s.basePath, folder, entry.Name()), folder == "texts")
+			if err != nil {
+				return nil, err
+			}
+
+			chat, ok := chats[chatID]
+			if !ok {
+				chat = &Chat{ChatID: chatID}
+				chats[chatID] = chat
+			}
+			if chat.Username == "" || lastSeen.After(chat.LastSeen) {
+				chat.Username, chat.LastSeen = username, lastSeen
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.basePath, "contacts"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list contacts: %w", err)
+	}
+	for _, entry := range entries {
+		chatID, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		contact, err := s.GetContact(ctx, chatID)
+		if err != nil {
+			return nil, err
+		}
+
+		chat, ok := chats[chatID]
+		if !ok {
+			chat = &Chat{ChatID: chatID, Username: contact.Username}
+			chats[chatID] = chat
+		}
+		chat.PhoneNumber = contact.PhoneNumber
+		if contact.Timestamp.After(chat.LastSeen) {
+			chat.LastSeen = contact.Timestamp
+		}
+	}
+
+	list := make([]Chat, 0, len(chats))
+	for _, chat := range chats {
+		if chat.Blocked, err = s.IsBlocked(ctx, chat.ChatID); err != nil {
+			return nil, err
+		}
+		list = append(list, *chat)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].LastSeen.Equal(list[j].LastSeen) {
+			return list[i].LastSeen.After(list[j].LastSeen)
+		}
+		return list[i].ChatID < list[j].ChatID
+	})
+	return list, nil
+}
+
+// GetContact returns the contact a user shared, or ErrContactNotFound
+func (s *LocalStorage) GetContact(ctx context.Context, chatID int64) (ContactInfo, error) {
+	var contact ContactInfo
+
+	data, err := os.ReadFile(filepath.Join(s.basePath, "contacts", fmt.Sprintf("%d.json", chatID)))
+	if errors.Is(err, os.ErrNotExist) {
+		return contact, ErrContactNotFound
+	}
+	if err != nil {
+		return contact, fmt.Errorf("failed to read contact info: %w", err)
+	}
+	if err := json.Unmarshal(data, &contact); err != nil {
+		return contact, fmt.Errorf("failed to decode contact info: %w", err)
+	}
+	return contact, nil
+}
+
+// ListMessages returns messages in the order they were received. Every file of the selected
+// chats is read, so this gets slower as chats grow.
+//
+// Media files carry no metadata of their own: their message ID comes from the reference
+// record and is zero for files stored before content was deduplicated, and their sender's
+// user ID isn't known.
+func (s *LocalStorage) ListMessages(ctx context.Context, filter MessageFilter) ([]Message, error) {
+	var messages []Message
+
+	texts, err := s.listTexts(filter)
+	if err != nil {
+		return nil, err
+	}
+	messages = append(messages, texts...)
+
+	if filter.matchesKind(KindVoice) {
+		voices, err := s.listVoices(filter)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, voices...)
+	}
+
+	refs, err := s.chatRefs(filter.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	for _, kind := range mediaKinds {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !filter.matchesKind(MessageKind(kind)) {
+			continue
+		}
+		media, err := s.listMedia(filter, kind, refs)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, media...)
+	}
+
+	if filter.Search != "" {
+		matching := messages[:0]
+		for _, message := range messages {
+			if filter.matchesSearch(message) {
+				matching = append(matching, message)
+			}
+		}
+		messages = matching
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		a, b := messages[i], messages[j]
+		if filter.NewestFirst {
+			a, b = b, a
+		}
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if a.ChatID != b.ChatID {
+			return a.ChatID < b.ChatID
+		}
+		return a.MessageID < b.MessageID
+	})
+
+	if filter.offset() >= len(messages) {
+		return []Message{}, nil
+	}
+	messages = messages[filter.offset():]
+	if len(messages) > filter.limit() {
+		messages = messages[:filter.limit()]
+	}
+	return messages, nil
+}
+
+// CountMessages reads every stored message, like ListMessages does
+func (s *LocalStorage) CountMessages(ctx context.Context) (map[MessageKind]int, error) {
+	messages, err := s.ListMessages(ctx, MessageFilter{Limit: math.MaxInt})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[MessageKind]int)
+	for _, message := range messages {
+		if !message.Outbound {
+			counts[message.Kind]++
+		}
+	}
+	return counts, nil
+}
+
+// listTexts reads the text messages of a chat from its per-day files, skipping the days
+// outside the filter's time range
+func (s *LocalStorage) listTexts(filter MessageFilter) ([]Message, error) {
+	if !filter.matchesKind(KindText) {
+		return nil, nil
+	}
+
+	var messages []Message
+	for _, folder := range s.chatFoldersOf("texts", filter.ChatID) {
+		files, err := filepath.Glob(filepath.Join(folder, "*.jsonl"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			day, err := time.Parse("2006-01-02", strings.TrimSuffix(filepath.Base(file), ".jsonl"))
+			if err != nil {
+				continue
+			}
+			if (!filter.Since.IsZero() && day.AddDate(0, 0, 1).Before(filter.Since)) ||
+				(!filter.Until.IsZero() && !day.Before(filter.Until)) {
+				continue
+			}
+
+			dayMessages, err := readTextFile(file)
+			if err != nil {
+				return nil, err
+			}
+			for _, message := range dayMessages {
+				if filter.matches(KindText, message.Timestamp) {
+					messages = append(messages, Message{MessageInfo: message.MessageInfo, Kind: KindText, Text: message.Text})
+				}
+			}
+		}
+	}
+	return messages, nil
+}
+
+// listVoices reads the voice messages of a chat from their metadata sidecars. Recordings
+// stored before sidecars were written are listed with what their file names tell.
+func (s *LocalStorage) listVoices(filter MessageFilter) ([]Message, error) {
+	var messages []Message
+	for _, folder := range s.chatFoldersOf("voices", filter.ChatID) {
+		recordings, err := filepath.Glob(filepath.Join(folder, "*.ogg"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, recording := range recordings {
+			base := strings.TrimSuffix(recording, ".ogg")
+
+			var voice VoiceInfo
+			data, err := os.ReadFile(base + ".json")
+			switch {
+			case err == nil:
+				if err := json.Unmarshal(data, &voice); err != nil {
+					return nil, fmt.Errorf("failed to decode voice info: %w", err)
+				}
+			case errors.Is(err, os.ErrNotExist):
+				voice.MessageInfo = fileMessageInfo(folder, filepath.Base(base))
+			default:
+				return nil, fmt.Errorf("failed to read voice info: %w", err)
+			}
+			if !filter.matches(KindVoice, voice.Timestamp) {
+				continue
+			}
+
+			message := Message{
+				MessageInfo: voice.MessageInfo,
+				Kind:        KindVoice,
+				Text:        voice.Caption,
+				FileName:    filepath.Base(recording),
+				Duration:    voice.Duration,
+			}
+			if stat, err := os.Stat(recording); err == nil {
+				message.Size = stat.Size()
+			}
+			if transcript, err := os.ReadFile(base + ".txt"); err == nil {
+				message.Transcript = strings.TrimSpace(string(transcript))
+			}
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+// listMedia lists the media files of one kind stored for a chat. refs maps the files' paths,
+// relative to the storage path, to the IDs of the messages they came with.
+func (s *LocalStorage) listMedia(filter MessageFilter, kind MediaKind, refs map[string]int) ([]Message, error) {
+	var messages []Message
+	for _, folder := range s.chatFoldersOf(kind.Folder(), filter.ChatID) {
+		entries, err := os.ReadDir(folder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", folder, err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info := fileMessageInfo(folder, entry.Name())
+			if !filter.matches(MessageKind(kind), info.Timestamp) {
+				continue
+			}
+
+			filePath := filepath.Join(folder, entry.Name())
+			if relPath, err := filepath.Rel(s.basePath, filePath); err == nil {
+				info.MessageID = refs[relPath]
+			}
+
+			message := Message{MessageInfo: info, Kind: MessageKind(kind), FileName: originalFileName(MessageKind(kind), entry.Name())}
+			if stat, err := entry.Info(); err == nil {
+				message.Size = stat.Size()
+			}
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+// GetMedia opens the attachment of a stored message, or returns ErrMediaNotFound. Like
+// DeleteMedia it finds attachments by their reference record, which files stored before
+// content was deduplicated don't have.
+func (s *LocalStorage) GetMedia(ctx context.Context, chatID int64, messageID int) (*Media, error) {
+	data, err := os.ReadFile(s.refPath(chatID, messageID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrMediaNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reference record: %w", err)
+	}
+	var ref mediaRef
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return nil, fmt.Errorf("failed to decode reference record: %w", err)
+	}
+
+	file, err := os.Open(filepath.Join(s.basePath, ref.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrMediaNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open media: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open media: %w", err)
+	}
+
+	kind := MessageKind(ref.Kind)
+	return &Media{ReadCloser: file, Kind: kind, FileName: originalFileName(kind, filepath.Base(ref.Path)), Size: stat.Size()}, nil
+}
+
+// chatFolders returns the folders holding per-chat subfolders
+func (s *LocalStorage) chatFolders() []string {
+	folders := []string{"texts", "voices"}
+	for _, kind := range mediaKinds {
+		folders = append(folders, kind.Folder())
+	}
+	return folders
+}
+
+// chatFoldersOf returns the <chatID>_<username> subfolders of folder, one per username the
+// chat was stored under, or those of every chat if chatID is zero
+func (s *LocalStorage) chatFoldersOf(folder string, chatID int64) []string {
+	pattern := "*_*"
+	if chatID != 0 {
+		pattern = strconv.FormatInt(chatID, 10) + "_*"
+	}
+	folders, _ := filepath.Glob(filepath.Join(s.basePath, folder, pattern))
+	return folders
+}
+
+// chatRefs maps the paths of a chat's attachments, or those of every chat if chatID is zero,
+// relative to the storage path, to the IDs of their messages
+func (s *LocalStorage) chatRefs(chatID int64) (map[string]int, error) {
+	dirs := []string{filepath.Dir(s.refPath(chatID, 0))}
+	if chatID == 0 {
+		dirs, _ = filepath.Glob(filepath.Join(s.basePath, "refs", "*"))
+	}
+
+	refs := make(map[string]int)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list reference records: %w", err)
+		}
+
+		for _, entry := range entries {
+			messageID, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".json"))
+			if err != nil {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read reference record: %w", err)
+			}
+			var ref mediaRef
+			if err := json.Unmarshal(data, &ref); err != nil {
+				return nil, fmt.Errorf("failed to decode reference record: %w", err)
+			}
+			refs[ref.Path] = messageID
+		}
+	}
+	return refs, nil
+}
+
+// parseChatFolder splits a <chatID>_<username> folder name
+func parseChatFolder(name string) (int64, string, bool) {
+	id, username, ok := strings.Cut(name, "_")
+	if !ok {
+		return 0, "", false
+	}
+	chatID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return chatID, username, true
+}
+
+// originalFileName returns the name an attachment was sent with from the name it is stored
+// under, which media files prefix with their receive time. Voice messages keep their stored name.
+func originalFileName(kind MessageKind, storedName string) string {
+	if kind == KindVoice {
+		return storedName
+	}
+	prefix, name, ok := strings.Cut(storedName, "_")
+	if _, err := strconv.ParseInt(prefix, 10, 64); !ok || err != nil {
+		return storedName
+	}
+	return name
+}
+
+// fileMessageInfo describes the message a file named <unix>_... in a chat folder came with
+func fileMessageInfo(folder, fileName string) MessageInfo {
+	var info MessageInfo
+	info.ChatID, info.Username, _ = parseChatFolder(filepath.Base(folder))
+
+	prefix, _, _ := strings.Cut(fileName, "_")
+	if unix, err := strconv.ParseInt(prefix, 10, 64); err == nil {
+		info.Timestamp = time.Unix(unix, 0)
+	}
+	return info
+}
+
+// lastReceived returns when the newest message in a chat folder was received. Text folders
+// hold per-day files of messages, the others files named by their receive time.
+func lastReceived(folder string, texts bool) (time.Time, error) {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to list %s: %w", folder, err)
+	}
+
+	var last time.Time
+	if !texts {
+		for _, entry := range entries {
+			if timestamp := fileMessageInfo(folder, entry.Name()).Timestamp; timestamp.After(last) {
+				last = timestamp
+			}
+		}
+		return last, nil
+	}
+
+	// Day files sort by name, and the last line of the newest is the latest message
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !strings.HasSuffix(entries[i].Name(), ".jsonl") {
+			continue
+		}
+		messages, err := readTextFile(filepath.Join(folder, entries[i].Name()))
+		if err != nil {
+			return last, err
+		}
+		for _, message := range messages {
+			if !message.Outbound && message.Timestamp.After(last) {
+				last = message.Timestamp
+			}
+		}
+		if !last.IsZero() {
+			break
+		}
+	}
+	return last, nil
+}
+
+// readTextFile reads a per-day JSONL file of text messages, skipping lines that don't decode,
+// such as one cut short by a crash
+func readTextFile(path string) ([]TextMessage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var messages []TextMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var message TextMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			continue
+		}
+		messages = append(messages, message)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return messages, nil
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queryEpoch is when the first message of storeQueryFixture was received
+var queryEpoch = time.Unix(1700000000, 0)
+
+// storeQueryFixture stores, in chat 1, texts 10 and 11, photo 12, voice 13 with a transcript
+// and reply 14 sent by the bot, an hour apart, and in chat 2, which is blocked, a contact and
+// text 20 half an hour after the first
+func storeQueryFixture(t *testing.T, s MessageStorage) {
+	t.Helper()
+	ctx := context.Background()
+	info := func(chatID int64, messageID int, username string, after time.Duration) MessageInfo {
+		return MessageInfo{MessageID: messageID, ChatID: chatID, UserID: chatID, Username: username, Timestamp: queryEpoch.Add(after)}
+	}
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check(s.SaveTextMessage(ctx, TextMessage{MessageInfo: info(1, 10, "alice", 0), Text: "Hello world"}))
+	check(s.SaveTextMessage(ctx, TextMessage{MessageInfo: info(1, 11, "alice", time.Hour), Text: "second note at 10:00"}))
+	check(s.SaveMediaFile(ctx, MediaInfo{MessageInfo: info(1, 12, "alice", 2*time.Hour), Kind: MediaPhoto, FileName: "pic.jpg"},
+		strings.NewReader("jpeg data")))
+	voice := VoiceInfo{MessageInfo: info(1, 13, "alice", 3*time.Hour), Duration: 4}
+	check(s.SaveVoiceMessage(ctx, voice, strings.NewReader("ogg data")))
+	check(s.SaveTranscript(ctx, voice.MessageInfo, "hello from a voice message"))
+	reply := info(1, 14, "alice", 4*time.Hour)
+	reply.UserID, reply.Outbound = 99, true
+	check(s.SaveTextMessage(ctx, TextMessage{MessageInfo: reply, Text: "thanks"}))
+
+	check(s.SaveContactInfo(ctx, 2, "bob", "+200", queryEpoch))
+	check(s.SaveTextMessage(ctx, TextMessage{MessageInfo: info(2, 20, "bob", 30*time.Minute), Text: "save 50% now"}))
+	check(s.SetBlocked(ctx, 2, true))
+}
+
+func TestStorageListChats(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		storeQueryFixture(t, s)
+
+		chats, err := s.ListChats(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chats) != 2 {
+			t.Fatalf("ListChats = %+v, want chats 1 and 2", chats)
+		}
+		if got := chats[0]; got.ChatID != 1 || got.Username != "alice" || got.PhoneNumber != "" || got.Blocked {
+			t.Errorf("first chat %+v, want chat 1 of alice, seen last", got)
+		}
+		if got := chats[1]; got.ChatID != 2 || got.Username != "bob" || got.PhoneNumber != "+200" || !got.Blocked ||
+			!got.LastSeen.Equal(queryEpoch.Add(30*time.Minute)) {
+			t.Errorf("second chat %+v, want blocked chat 2 of bob with his number, seen at its text", got)
+		}
+	})
+}
+
+func TestStorageListMessages(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter MessageFilter
+		want   []int
+	}{
+		{"chat", MessageFilter{ChatID: 1}, []int{10, 11, 12, 13, 14}},
+		{"all chats", MessageFilter{}, []int{10, 20, 11, 12, 13, 14}},
+		{"other chat", MessageFilter{ChatID: 2}, []int{20}},
+		{"unknown chat", MessageFilter{ChatID: 3}, []int{}},
+		{"since", MessageFilter{ChatID: 1, Since: queryEpoch.Add(3 * time.Hour)}, []int{13, 14}},
+		{"until", MessageFilter{ChatID: 1, Until: queryEpoch.Add(time.Hour)}, []int{10}},
+		{"time range", MessageFilter{ChatID: 1, Since: queryEpoch.Add(time.Hour), Until: queryEpoch.Add(3 * time.Hour)}, []int{11, 12}},
+		{"text", MessageFilter{ChatID: 1, Kinds: []MessageKind{KindText}}, []int{10, 11, 14}},
+		{"voice and photo", MessageFilter{ChatID: 1, Kinds: []MessageKind{KindVoice, MessageKind(MediaPhoto)}}, []int{12, 13}},
+		{"kind not stored", MessageFilter{ChatID: 1, Kinds: []MessageKind{MessageKind(MediaVideo)}}, []int{}},
+		{"search text and transcript", MessageFilter{ChatID: 1, Search: "HELLO"}, []int{10, 13}},
+		{"search percent sign", MessageFilter{Search: "0%"}, []int{20}},
+		{"search underscore", MessageFilter{Search: "o_w"}, []int{}},
+		{"search backslash", MessageFilter{Search: `\`}, []int{}},
+		{"search and kind", MessageFilter{ChatID: 1, Search: "hello", Kinds: []MessageKind{KindText}}, []int{10}},
+		{"limit", MessageFilter{ChatID: 1, Limit: 2}, []int{10, 11}},
+		{"offset", MessageFilter{ChatID: 1, Limit: 2, Offset: 2}, []int{12, 13}},
+		{"last page", MessageFilter{ChatID: 1, Limit: 2, Offset: 4}, []int{14}},
+		{"offset past the end", MessageFilter{ChatID: 1, Offset: 5}, []int{}},
+		{"negative offset", MessageFilter{ChatID: 1, Limit: 2, Offset: -5}, []int{10, 11}},
+		{"negative limit", MessageFilter{ChatID: 1, Limit: -1}, []int{10, 11, 12, 13, 14}},
+		{"newest first", MessageFilter{ChatID: 1, Limit: 2, NewestFirst: true}, []int{14, 13}},
+		{"newest first offset", MessageFilter{ChatID: 1, Limit: 2, Offset: 2, NewestFirst: true}, []int{12, 11}},
+	}
+
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		storeQueryFixture(t, s)
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				messages, err := s.ListMessages(context.Background(), tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := make([]int, len(messages))
+				for i, message := range messages {
+					got[i] = message.MessageID
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("ListMessages = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestStorageListMessagesFields(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		storeQueryFixture(t, s)
+
+		messages, err := s.ListMessages(context.Background(), MessageFilter{ChatID: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 5 {
+			t.Fatalf("ListMessages returned %d messages, want 5", len(messages))
+		}
+
+		if got := messages[0]; got.Kind != KindText || got.Text != "Hello world" || got.Username != "alice" ||
+			!got.Timestamp.Equal(queryEpoch) {
+			t.Errorf("text %+v", got)
+		}
+		if got := messages[2]; got.Kind != MessageKind(MediaPhoto) || got.Size != int64(len("jpeg data")) {
+			t.Errorf("photo %+v", got)
+		}
+		if got := messages[3]; got.Kind != KindVoice || got.Duration != 4 || got.Transcript != "hello from a voice message" {
+			t.Errorf("voice %+v", got)
+		}
+		if got := messages[4]; !got.Outbound || got.Text != "thanks" {
+			t.Errorf("reply %+v", got)
+		}
+	})
+}
+
+func TestStorageCountMessages(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		ctx := context.Background()
+		if counts, err := s.CountMessages(ctx); err != nil || len(counts) != 0 {
+			t.Errorf("CountMessages of an empty storage = %v, %v", counts, err)
+		}
+
+		storeQueryFixture(t, s)
+		counts, err := s.CountMessages(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The bot's reply isn't counted
+		want := map[MessageKind]int{KindText: 3, KindVoice: 1, MessageKind(MediaPhoto): 1}
+		if !reflect.DeepEqual(counts, want) {
+			t.Errorf("CountMessages = %v, want %v", counts, want)
+		}
+	})
+}
+
+func TestStorageGetMedia(t *testing.T) {
+	tests := []struct {
+		name      string
+		chatID    int64
+		messageID int
+		kind      MessageKind
+		content   string
+	}{
+		{"photo", 1, 12, MessageKind(MediaPhoto), "jpeg data"},
+		{"voice", 1, 13, KindVoice, "ogg data"},
+		{"text", 1, 10, "", ""},
+		{"other chat", 2, 12, "", ""},
+		{"unknown message", 1, 99, "", ""},
+	}
+
+	forEachBackend(t, func(t *testing.T, s MessageStorage) {
+		storeQueryFixture(t, s)
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				media, err := s.GetMedia(context.Background(), tt.chatID, tt.messageID)
+				if tt.content == "" {
+					if !errors.Is(err, ErrMediaNotFound) {
+						t.Errorf("GetMedia = %v, want ErrMediaNotFound", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				media.Close()
+				if media.Kind != tt.kind || media.Size != int64(len(tt.content)) {
+					t.Errorf("GetMedia = %s of %d bytes, want %s of %d", media.Kind, media.Size, tt.kind, len(tt.content))
+				}
+				if got := readMedia(t, s, tt.chatID, tt.messageID); got != tt.content {
+					t.Errorf("content %q, want %q", got, tt.content)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,941 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"telegram-message-receiver/logger"
+	"telegram-message-receiver/metrics"
+)
+
+// Message kinds recorded in the messages table besides the media kinds
+const (
+	kindText    = "text"
+	kindVoice   = "voice"
+	kindContact = "contact"
+)
+
+// sqlDialect describes what differs between the databases SQLStorage runs on. Queries are
+// otherwise shared, which is why they number their placeholders ($1, $2, ...) in order of
+// appearance: both SQLite and PostgreSQL accept that form.
+type sqlDialect struct {
+	name string
+	// migrations are applied in order on startup; append new ones, never edit applied ones
+	migrations []string
+	// lockMigrations and unlockMigrations, if set, keep several processes sharing the database
+	// from migrating it at the same time
+	lockMigrations   string
+	unlockMigrations string
+	// forUpdate is appended to a SELECT to lock the rows it returns until the transaction ends.
+	// It is empty where the database only allows one writer at a time anyway.
+	forUpdate string
+}
+
+// SQLStorage keeps messages, contacts and media metadata in a SQL database.
+// Media content is written to the media store, or into the database when storeBlobs is set. Each
+// distinct content is stored once in media_content and shared by the media rows referencing it.
+type SQLStorage struct {
+	db         *sql.DB
+	dialect    sqlDialect
+	media      MediaStore
+	storeBlobs bool
+	logger     *logger.Logger
+}
+
+// newSQLStorage migrates db to the dialect's latest schema and returns the storage using it.
+// db is closed if that fails.
+func newSQLStorage(db *sql.DB, dialect sqlDialect, media MediaStore, storeBlobs bool, logger *logger.Logger) (*SQLStorage, error) {
+	s := &SQLStorage{db: db, dialect: dialect, media: media, storeBlobs: storeBlobs, logger: logger}
+	if err := s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLStorage) migrate(ctx context.Context) error {
+	// Everything runs on one connection so a session lock covers all of it
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer conn.Close()
+
+	if s.dialect.lockMigrations != "" {
+		if _, err := conn.ExecContext(ctx, s.dialect.lockMigrations); err != nil {
+			return fmt.Errorf("failed to lock migrations: %w", err)
+		}
+		defer conn.ExecContext(context.Background(), s.dialect.unlockMigrations)
+	}
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var current int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := current; i < len(s.dialect.migrations); i++ {
+		version := i + 1
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, s.dialect.migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`, version, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", version, err)
+		}
+		s.logger.Info("Applied database migration", "database", s.dialect.name, "version", version)
+	}
+
+	return nil
+}
+
+func (s *SQLStorage) Close() error {
+	return s.db.Close()
+}
+
+// SaveVoiceMessage stores the recording like other media and its metadata in the voice_info
+// table, in the same transaction
+func (s *SQLStorage) SaveVoiceMessage(ctx context.Context, voice VoiceInfo, reader io.Reader) error {
+	fileName := voiceBaseName(voice.MessageInfo) + ".ogg"
+	return s.saveMedia(ctx, voice.MessageInfo, kindVoice, "voices", fileName, fileName, voice.FileUniqueID, reader, voiceInfoRecorder(ctx, voice))
+}
+
+func (s *SQLStorage) SaveVoiceReference(ctx context.Context, voice VoiceInfo) (bool, error) {
+	return s.saveReference(ctx, voice.MessageInfo, kindVoice, "", voice.FileUniqueID, voiceInfoRecorder(ctx, voice))
+}
+
+// voiceInfoRecorder returns the saveMedia callback that stores the metadata of a voice message
+func voiceInfoRecorder(ctx context.Context, voice VoiceInfo) func(tx *sql.Tx, messageID int64, checksum string) error {
+	return func(tx *sql.Tx, messageID int64, checksum string) error {
+		voice.SHA256 = checksum
+		metadata, err := json.Marshal(voice)
+		if err != nil {
+			return fmt.Errorf("failed to marshal voice info: %w", err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO voice_info (message_id, metadata, sha256) VALUES ($1, $2, $3)`,
+			messageID, string(metadata), checksum); err != nil {
+			return fmt.Errorf("failed to save voice info: %w", err)
+		}
+		return nil
+	}
+}
+
+// SaveMediaFile stores the attachment under its original name. Its media store key is named
+// after its message like voiceBaseName does, so files with the same name sent in the same
+// second never share a key.
+func (s *SQLStorage) SaveMediaFile(ctx context.Context, media MediaInfo, reader io.Reader) error {
+	fileName := sanitizeFileName(media.FileName)
+	return s.saveMedia(ctx, media.MessageInfo, string(media.Kind), media.Kind.Folder(), fileName,
+		voiceBaseName(media.MessageInfo)+"_"+fileName, media.FileUniqueID, reader, nil)
+}
+
+func (s *SQLStorage) SaveMediaReference(ctx context.Context, media MediaInfo) (bool, error) {
+	var fileName string
+	if media.FileName != "" {
+		fileName = sanitizeFileName(media.FileName)
+	}
+	return s.saveReference(ctx, media.MessageInfo, string(media.Kind), fileName, media.FileUniqueID, nil)
+}
+
+// uniqueKeyName adds a random token to fileName before its extension. Two saves of the same
+// message that race past the duplicate check then write to different media store keys, so the
+// one that loses removes its own copy rather than the winner's.
+func uniqueKeyName(fileName string) (string, error) {
+	token := make([]byte, 4)
+	if _, err := rand.Read(token); err != nil {
+		return "", fmt.Errorf("failed to generate media key: %w", err)
+	}
+	ext := path.Ext(fileName)
+	return strings.TrimSuffix(fileName, ext) + "_" + hex.EncodeToString(token) + ext, nil
+}
+
+// saveMedia stores the content of reader, unless identical content is stored already, and
+// records it in the messages and media tables as fileName. The media store key is keyName with
+// a random token added. If record is set it is called within the same transaction with the new
+// message's row ID and the SHA-256 checksum of the content, to store anything else that belongs
+// with it.
+func (s *SQLStorage) saveMedia(ctx context.Context, info MessageInfo, kind, folder, fileName, keyName, fileUniqueID string, reader io.Reader,
+	record func(tx *sql.Tx, messageID int64, checksum string) error) error {
+	var (
+		relPath string
+		data    []byte
+		size    int64
+	)
+
+	// Checked up front so a replayed update doesn't write a second file; the unique index still has the final say
+	if info.MessageID != 0 {
+		seen, err := s.HasMessage(ctx, info.ChatID, info.MessageID)
+		if err != nil {
+			return err
+		}
+		if seen {
+			return ErrDuplicateMessage
+		}
+	}
+
+	hash := sha256.New()
+	reader = io.TeeReader(reader, hash)
+
+	if s.storeBlobs {
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, contextReader{ctx: ctx, reader: reader})
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", kind, err)
+		}
+		data, size = buf.Bytes(), n
+	} else {
+		key, err := uniqueKeyName(keyName)
+		if err != nil {
+			return err
+		}
+		relPath = path.Join(folder, fmt.Sprintf("%d_%s", info.ChatID, info.Username), key)
+		n, err := s.media.Put(ctx, relPath, reader)
+		if err != nil {
+			return fmt.Errorf("failed to save %s: %w", kind, err)
+		}
+		size = n
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	// The new file is removed if the transaction fails, or if the content turns out to be stored
+	// under another path already
+	keep := false
+	defer func() {
+		if !keep && relPath != "" {
+			s.media.Delete(context.Background(), relPath)
+		}
+	}()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	messageID, err := insertMessage(ctx, tx, info, kind, nil)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO media_content (sha256, file_name, path, data, size) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (sha256) DO NOTHING`, checksum, fileName, nullString(relPath), data, size)
+	if err != nil {
+		return fmt.Errorf("failed to save media content: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	shared := inserted == 0
+
+	storedPath := relPath
+	if shared {
+		var path sql.NullString
+		if err := tx.QueryRowContext(ctx, `SELECT path FROM media_content WHERE sha256 = $1`, checksum).Scan(&path); err != nil {
+			return fmt.Errorf("failed to look up media content: %w", err)
+		}
+		storedPath = path.String
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO media (message_id, file_name, size, sha256, file_unique_id) VALUES ($1, $2, $3, $4, $5)`,
+		messageID, fileName, size, checksum, nullString(fileUniqueID)); err != nil {
+		return fmt.Errorf("failed to save media record: %w", err)
+	}
+
+	if record != nil {
+		if err := record(tx, messageID, checksum); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit %s: %w", kind, err)
+	}
+	keep = storedPath == relPath
+
+	if shared {
+		metrics.MediaDeduplicated.Inc()
+	}
+	metrics.MessagesStored.WithLabelValues(kind).Inc()
+	logger.FromContext(ctx, s.logger).Info("Media file saved", "kind", kind, "size", size, "sha256", checksum, "shared", shared)
+	return nil
+}
+
+// saveReference records a message whose attachment is the content stored before for
+// fileUniqueID, returning false if there is none. fileName defaults to the stored content's.
+func (s *SQLStorage) saveReference(ctx context.Context, info MessageInfo, kind, fileName, fileUniqueID string,
+	record func(tx *sql.Tx, messageID int64, checksum string) error) (bool, error) {
+	if fileUniqueID == "" {
+		return false, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		checksum   string
+		storedName string
+		size       int64
+	)
+	err = tx.QueryRowContext(ctx, `SELECT c.sha256, c.file_name, c.size FROM media m JOIN media_content c ON c.sha256 = m.sha256
+		WHERE m.file_unique_id = $1 LIMIT 1`, fileUniqueID).Scan(&checksum, &storedName, &size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up media content: %w", err)
+	}
+	if fileName == "" {
+		fileName = storedName
+	}
+
+	messageID, err := insertMessage(ctx, tx, info, kind, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO media (message_id, file_name, size, sha256, file_unique_id) VALUES ($1, $2, $3, $4, $5)`,
+		messageID, fileName, size, checksum, fileUniqueID); err != nil {
+		return false, fmt.Errorf("failed to save media record: %w", err)
+	}
+
+	if record != nil {
+		if err := record(tx, messageID, checksum); err != nil {
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit %s: %w", kind, err)
+	}
+
+	metrics.MediaDeduplicated.Inc()
+	metrics.MessagesStored.WithLabelValues(kind).Inc()
+	logger.FromContext(ctx, s.logger).Info("Media file saved", "kind", kind, "size", size, "sha256", checksum, "shared", true)
+	return true, nil
+}
+
+// DeleteMedia deletes a media message together with its transcript, metadata and converted
+// copies. Its content is deleted once no other media row references it.
+func (s *SQLStorage) DeleteMedia(ctx context.Context, chatID int64, messageID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		rowID    int64
+		checksum sql.NullString
+		path     sql.NullString
+	)
+	err = tx.QueryRowContext(ctx, `SELECT m.message_id, m.sha256, m.path FROM media m JOIN messages msg ON msg.id = m.message_id
+		WHERE msg.chat_id = $1 AND msg.telegram_message_id = $2`, chatID, messageID).Scan(&rowID, &checksum, &path)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrMediaNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up media: %w", err)
+	}
+
+	// Rows stored before content was shared keep their own path
+	var remove []string
+	if path.Valid {
+		remove = append(remove, path.String)
+	}
+
+	variants, err := queryStrings(ctx, tx, `SELECT path FROM voice_variants WHERE message_id = $1 AND path IS NOT NULL`, rowID)
+	if err != nil {
+		return fmt.Errorf("failed to look up voice variants: %w", err)
+	}
+	remove = append(remove, variants...)
+
+	// Keeps the content from being shared or released by another transaction until this one ends
+	if checksum.Valid && s.dialect.forUpdate != "" {
+		if _, err := tx.ExecContext(ctx, `SELECT sha256 FROM media_content WHERE sha256 = $1`+s.dialect.forUpdate, checksum.String); err != nil {
+			return fmt.Errorf("failed to lock media content: %w", err)
+		}
+	}
+
+	// Cascades to the media, transcript, voice info and variant rows
+	if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE id = $1`, rowID); err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+
+	if checksum.Valid {
+		var refs int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM media WHERE sha256 = $1`, checksum.String).Scan(&refs); err != nil {
+			return fmt.Errorf("failed to count media references: %w", err)
+		}
+		if refs == 0 {
+			var contentPath sql.NullString
+			if err := tx.QueryRowContext(ctx, `DELETE FROM media_content WHERE sha256 = $1 RETURNING path`, checksum.String).Scan(&contentPath); err != nil {
+				return fmt.Errorf("failed to delete media content: %w", err)
+			}
+			if contentPath.Valid {
+				remove = append(remove, contentPath.String)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit deletion: %w", err)
+	}
+
+	for _, relPath := range remove {
+		if err := s.media.Delete(ctx, relPath); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", relPath, err)
+		}
+	}
+
+	logger.FromContext(ctx, s.logger).Info("Media deleted")
+	return nil
+}
+
+func (s *SQLStorage) SaveTextMessage(ctx context.Context, message TextMessage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := insertMessage(ctx, tx, message.MessageInfo, kindText, &message.Text); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit text message: %w", err)
+	}
+
+	metrics.MessagesStored.WithLabelValues(kindText).Inc()
+	logger.FromContext(ctx, s.logger).Info("Text message saved")
+	return nil
+}
+
+func (s *SQLStorage) SaveVoiceVariant(ctx context.Context, info MessageInfo, format string, reader io.Reader) error {
+	messageID, err := s.messageRowID(ctx, info)
+	if err != nil {
+		return err
+	}
+
+	var (
+		relPath string
+		data    []byte
+		size    int64
+	)
+	if s.storeBlobs {
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, contextReader{ctx: ctx, reader: reader})
+		if err != nil {
+			return fmt.Errorf("failed to read %s variant: %w", format, err)
+		}
+		data, size = buf.Bytes(), n
+	} else {
+		relPath = path.Join("voices", fmt.Sprintf("%d_%s", info.ChatID, info.Username), voiceBaseName(info)+"."+format)
+		n, err := s.media.Put(ctx, relPath, reader)
+		if err != nil {
+			return fmt.Errorf("failed to save %s variant: %w", format, err)
+		}
+		size = n
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO voice_variants (message_id, format, path, data, size) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (message_id, format) DO UPDATE SET path = excluded.path, data = excluded.data, size = excluded.size`,
+		messageID, format, nullString(relPath), data, size); err != nil {
+		return fmt.Errorf("failed to save %s variant record: %w", format, err)
+	}
+
+	if err := addVoiceInfoVariant(ctx, tx, messageID, format); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit %s variant: %w", format, err)
+	}
+
+	logger.FromContext(ctx, s.logger).Info("Voice variant saved", "format", format, "size", size)
+	return nil
+}
+
+// addVoiceInfoVariant lists format in the stored metadata of a voice message
+func addVoiceInfoVariant(ctx context.Context, tx *sql.Tx, messageID int64, format string) error {
+	var metadata string
+	if err := tx.QueryRowContext(ctx, `SELECT metadata FROM voice_info WHERE message_id = $1`, messageID).Scan(&metadata); err != nil {
+		return fmt.Errorf("failed to read voice info: %w", err)
+	}
+
+	var voice VoiceInfo
+	if err := json.Unmarshal([]byte(metadata), &voice); err != nil {
+		return fmt.Errorf("failed to decode voice info: %w", err)
+	}
+	voice.Variants = addVariant(voice.Variants, format)
+
+	updated, err := json.Marshal(voice)
+	if err != nil {
+		return fmt.Errorf("failed to marshal voice info: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE voice_info SET metadata = $1 WHERE message_id = $2`, string(updated), messageID); err != nil {
+		return fmt.Errorf("failed to save voice info: %w", err)
+	}
+	return nil
+}
+
+// messageRowID returns the messages table ID of a stored Telegram message
+func (s *SQLStorage) messageRowID(ctx context.Context, info MessageInfo) (int64, error) {
+	var id int64
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM messages WHERE chat_id = $1 AND telegram_message_id = $2`,
+		info.ChatID, info.MessageID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("message %d in chat %d is not stored", info.MessageID, info.ChatID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up message: %w", err)
+	}
+	return id, nil
+}
+
+func (s *SQLStorage) SaveTranscript(ctx context.Context, info MessageInfo, transcript string) error {
+	result, err := s.db.ExecContext(ctx, `INSERT INTO transcripts (message_id, text, created_at)
+		SELECT id, CAST($1 AS TEXT), CAST($2 AS BIGINT) FROM messages WHERE chat_id = $3 AND telegram_message_id = $4
+		ON CONFLICT (message_id) DO UPDATE SET text = excluded.text, created_at = excluded.created_at`,
+		transcript, time.Now().Unix(), info.ChatID, info.MessageID)
+	if err != nil {
+		return fmt.Errorf("failed to save transcript: %w", err)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("failed to save transcript: message %d in chat %d is not stored", info.MessageID, info.ChatID)
+	}
+
+	logger.FromContext(ctx, s.logger).Info("Transcript saved")
+	return nil
+}
+
+func (s *SQLStorage) SaveContactInfo(ctx context.Context, chatID int64, username string, phoneNumber string, timestamp time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := upsertUser(ctx, tx, chatID, username, timestamp); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO contacts (chat_id, phone_number, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (chat_id) DO UPDATE SET phone_number = excluded.phone_number, created_at = excluded.created_at`,
+		chatID, phoneNumber, timestamp.Unix()); err != nil {
+		return fmt.Errorf("failed to save contact info: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit contact info: %w", err)
+	}
+
+	metrics.MessagesStored.WithLabelValues(kindContact).Inc()
+	return nil
+}
+
+func (s *SQLStorage) HasContactInfo(ctx context.Context, chatID int64) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM contacts WHERE chat_id = $1)`, chatID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking contact info: %w", err)
+	}
+	return exists, nil
+}
+
+func (s *SQLStorage) HasMessage(ctx context.Context, chatID int64, messageID int) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM messages WHERE chat_id = $1 AND telegram_message_id = $2)
+		OR EXISTS (SELECT 1 FROM handled_messages WHERE chat_id = $1 AND telegram_message_id = $2)`,
+		chatID, messageID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking message: %w", err)
+	}
+	return exists, nil
+}
+
+// RecordMessage keeps the IDs of messages that aren't stored in handled_messages
+func (s *SQLStorage) RecordMessage(ctx context.Context, chatID int64, messageID int) error {
+	result, err := s.db.ExecContext(ctx, `INSERT INTO handled_messages (chat_id, telegram_message_id, created_at)
+		VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, chatID, messageID, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record message: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to record message: %w", err)
+	}
+	if inserted == 0 {
+		return ErrDuplicateMessage
+	}
+	return nil
+}
+
+func (s *SQLStorage) LoadUpdateOffset(ctx context.Context) (int, error) {
+	var offset int
+	err := s.db.QueryRowContext(ctx, `SELECT value FROM state WHERE key = 'update_offset'`).Scan(&offset)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read update offset: %w", err)
+	}
+	return offset, nil
+}
+
+func (s *SQLStorage) SaveUpdateOffset(ctx context.Context, updateID int) error {
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO state (key, value) VALUES ('update_offset', $1)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, updateID); err != nil {
+		return fmt.Errorf("failed to save update offset: %w", err)
+	}
+	return nil
+}
+
+// Check verifies that the database accepts writes and, unless media is kept in the database,
+// that the media store does
+func (s *SQLStorage) Check(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO state (key, value) VALUES ('health_check', $1)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, time.Now().Unix()); err != nil {
+		return fmt.Errorf("database is not writable: %w", err)
+	}
+
+	if !s.storeBlobs {
+		return s.media.Check(ctx)
+	}
+	return nil
+}
+
+func upsertUser(ctx context.Context, tx *sql.Tx, chatID int64, username string, timestamp time.Time) error {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO users (chat_id, username, first_seen, last_seen) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (chat_id) DO UPDATE SET username = excluded.username,
+			last_seen = CASE WHEN excluded.last_seen > users.last_seen THEN excluded.last_seen ELSE users.last_seen END`,
+		chatID, username, timestamp.Unix(), timestamp.Unix()); err != nil {
+		return fmt.Errorf("failed to save user: %w", err)
+	}
+	return nil
+}
+
+// insertUser adds a chat without touching it if it exists, for replies, which don't count as
+// hearing from the user
+func insertUser(ctx context.Context, tx *sql.Tx, chatID int64, username string, timestamp time.Time) error {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO users (chat_id, username, first_seen, last_seen) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (chat_id) DO NOTHING`,
+		chatID, username, timestamp.Unix(), timestamp.Unix()); err != nil {
+		return fmt.Errorf("failed to save user: %w", err)
+	}
+	return nil
+}
+
+func insertMessage(ctx context.Context, tx *sql.Tx, info MessageInfo, kind string, text *string) (int64, error) {
+	saveUser := upsertUser
+	if info.Outbound {
+		saveUser = insertUser
+	}
+	if err := saveUser(ctx, tx, info.ChatID, info.Username, info.Timestamp); err != nil {
+		return 0, err
+	}
+
+	// No row is returned when the message is already stored
+	var id int64
+	err := tx.QueryRowContext(ctx, `INSERT INTO messages (chat_id, kind, text, created_at, telegram_message_id, user_id, reply_to_id, outbound)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING RETURNING id`,
+		info.ChatID, kind, text, info.Timestamp.Unix(), nullInt64(int64(info.MessageID)), nullInt64(info.UserID), nullInt64(int64(info.ReplyToID)),
+		info.Outbound).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrDuplicateMessage
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to save %s message: %w", kind, err)
+	}
+	return id, nil
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern, for use with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// queryStrings returns the single string column of every row a query returns
+func queryStrings(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullInt64(n int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: n, Valid: n != 0}
+}
+
+func (s *SQLStorage) ListChats(ctx context.Context) ([]Chat, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT u.chat_id, u.username, c.phone_number, u.last_seen, b.chat_id IS NOT NULL
+		FROM users u
+		LEFT JOIN contacts c ON c.chat_id = u.chat_id
+		LEFT JOIN blocked_chats b ON b.chat_id = u.chat_id
+		ORDER BY u.last_seen DESC, u.chat_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chats: %w", err)
+	}
+	defer rows.Close()
+
+	chats := []Chat{}
+	for rows.Next() {
+		var (
+			chat     Chat
+			phone    sql.NullString
+			lastSeen int64
+		)
+		if err := rows.Scan(&chat.ChatID, &chat.Username, &phone, &lastSeen, &chat.Blocked); err != nil {
+			return nil, fmt.Errorf("failed to list chats: %w", err)
+		}
+		chat.PhoneNumber = phone.String
+		chat.LastSeen = time.Unix(lastSeen, 0)
+		chats = append(chats, chat)
+	}
+	return chats, rows.Err()
+}
+
+func (s *SQLStorage) CountMessages(ctx context.Context) (map[MessageKind]int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT kind, COUNT(*) FROM messages WHERE NOT outbound GROUP BY kind`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count messages: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[MessageKind]int)
+	for rows.Next() {
+		var (
+			kind  MessageKind
+			count int
+		)
+		if err := rows.Scan(&kind, &count); err != nil {
+			return nil, fmt.Errorf("failed to count messages: %w", err)
+		}
+		counts[kind] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s *SQLStorage) SetBlocked(ctx context.Context, chatID int64, blocked bool) error {
+	var err error
+	if blocked {
+		_, err = s.db.ExecContext(ctx, `INSERT INTO blocked_chats (chat_id, created_at) VALUES ($1, $2)
+			ON CONFLICT (chat_id) DO NOTHING`, chatID, time.Now().Unix())
+	} else {
+		_, err = s.db.ExecContext(ctx, `DELETE FROM blocked_chats WHERE chat_id = $1`, chatID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update blocked chat: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStorage) IsBlocked(ctx context.Context, chatID int64) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM blocked_chats WHERE chat_id = $1)`, chatID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking blocked chat: %w", err)
+	}
+	return exists, nil
+}
+
+func (s *SQLStorage) GetContact(ctx context.Context, chatID int64) (ContactInfo, error) {
+	var (
+		contact   ContactInfo
+		createdAt int64
+	)
+	err := s.db.QueryRowContext(ctx, `SELECT u.username, c.phone_number, c.created_at
+		FROM contacts c JOIN users u ON u.chat_id = c.chat_id WHERE c.chat_id = $1`, chatID).
+		Scan(&contact.Username, &contact.PhoneNumber, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return contact, ErrContactNotFound
+	}
+	if err != nil {
+		return contact, fmt.Errorf("failed to read contact info: %w", err)
+	}
+	contact.Timestamp = time.Unix(createdAt, 0)
+	return contact, nil
+}
+
+// ListMessages returns messages with the sender's current username; the messages table
+// doesn't keep the one they were sent under
+func (s *SQLStorage) ListMessages(ctx context.Context, filter MessageFilter) ([]Message, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.ChatID != 0 {
+		conditions = append(conditions, `m.chat_id = `+arg(filter.ChatID))
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, `m.created_at >= `+arg(filter.Since.Unix()))
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, `m.created_at < `+arg(filter.Until.Unix()))
+	}
+	if len(filter.Kinds) > 0 {
+		kinds := make([]string, len(filter.Kinds))
+		for i, kind := range filter.Kinds {
+			kinds[i] = arg(string(kind))
+		}
+		conditions = append(conditions, `m.kind IN (`+strings.Join(kinds, ", ")+`)`)
+	}
+	if filter.Search != "" {
+		// LOWER only folds ASCII letters in SQLite; PostgreSQL folds them all
+		pattern := "%" + likeEscaper.Replace(strings.ToLower(filter.Search)) + "%"
+		conditions = append(conditions, `((m.kind = '`+kindText+`' AND LOWER(m.text) LIKE `+arg(pattern)+` ESCAPE '\')
+			OR LOWER(t.text) LIKE `+arg(pattern)+` ESCAPE '\')`)
+	}
+
+	query := `SELECT m.chat_id, m.telegram_message_id, m.user_id, u.username, m.created_at, m.reply_to_id, m.outbound, m.kind, m.text,
+			md.file_name, md.size, t.text, vi.metadata
+		FROM messages m
+		JOIN users u ON u.chat_id = m.chat_id
+		LEFT JOIN media md ON md.message_id = m.id
+		LEFT JOIN transcripts t ON t.message_id = m.id
+		LEFT JOIN voice_info vi ON vi.message_id = m.id`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	if filter.NewestFirst {
+		query += ` ORDER BY m.created_at DESC, m.id DESC`
+	} else {
+		query += ` ORDER BY m.created_at, m.id`
+	}
+	query += ` LIMIT ` + arg(filter.limit()) + ` OFFSET ` + arg(filter.offset())
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var (
+			message                      = Message{MessageInfo: MessageInfo{ChatID: filter.ChatID}}
+			messageID, userID, replyToID sql.NullInt64
+			createdAt                    int64
+			text, fileName, transcript   sql.NullString
+			metadata                     sql.NullString
+			size                         sql.NullInt64
+		)
+		if err := rows.Scan(&message.ChatID, &messageID, &userID, &message.Username, &createdAt, &replyToID, &message.Outbound, &message.Kind, &text,
+			&fileName, &size, &transcript, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to list messages: %w", err)
+		}
+		message.MessageID = int(messageID.Int64)
+		message.UserID = userID.Int64
+		message.ReplyToID = int(replyToID.Int64)
+		message.Timestamp = time.Unix(createdAt, 0)
+		message.Text = text.String
+		message.FileName = fileName.String
+		message.Size = size.Int64
+		message.Transcript = transcript.String
+
+		if metadata.Valid {
+			var voice VoiceInfo
+			if err := json.Unmarshal([]byte(metadata.String), &voice); err != nil {
+				return nil, fmt.Errorf("failed to decode voice info: %w", err)
+			}
+			message.Text = voice.Caption
+			message.Duration = voice.Duration
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// GetMedia opens the attachment of a stored message from the media store, or from the
+// database if it is kept there
+func (s *SQLStorage) GetMedia(ctx context.Context, chatID int64, messageID int) (*Media, error) {
+	var (
+		media Media
+		key   sql.NullString
+		data  []byte
+	)
+	// Rows stored before content was shared have the content, or its key, themselves
+	err := s.db.QueryRowContext(ctx, `SELECT m.kind, md.file_name, md.size, COALESCE(md.path, c.path), COALESCE(md.data, c.data)
+		FROM media md
+		JOIN messages m ON m.id = md.message_id
+		LEFT JOIN media_content c ON c.sha256 = md.sha256
+		WHERE m.chat_id = $1 AND m.telegram_message_id = $2`, chatID, messageID).
+		Scan(&media.Kind, &media.FileName, &media.Size, &key, &data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMediaNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up media: %w", err)
+	}
+
+	if !key.Valid {
+		media.ReadCloser = io.NopCloser(bytes.NewReader(data))
+		return &media, nil
+	}
+
+	content, err := s.media.Open(ctx, key.String)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrMediaNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open media: %w", err)
+	}
+	media.ReadCloser = content
+	return &media, nil
+}
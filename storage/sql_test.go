@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"telegram-message-receiver/logger"
+)
+
+func newTestLogger(t *testing.T) *logger.Logger {
+	t.Helper()
+	logger, err := logger.NewLoggerWithOutput(io.Discard, slog.LevelError.String(), "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger
+}
+
+func newTestSQLite(t *testing.T) *SQLStorage {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := NewSQLiteStorage(filepath.Join(dir, "messages.db"), NewFileMediaStore(dir), false, newTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func readMedia(t *testing.T, s MessageStorage, chatID int64, messageID int) string {
+	t.Helper()
+	media, err := s.GetMedia(context.Background(), chatID, messageID)
+	if err != nil {
+		t.Fatalf("GetMedia(%d, %d): %v", chatID, messageID, err)
+	}
+	defer media.Close()
+
+	data, err := io.ReadAll(media)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func mediaFileName(t *testing.T, s MessageStorage, chatID int64, messageID int) string {
+	t.Helper()
+	media, err := s.GetMedia(context.Background(), chatID, messageID)
+	if err != nil {
+		t.Fatalf("GetMedia(%d, %d): %v", chatID, messageID, err)
+	}
+	media.Close()
+	return media.FileName
+}
+
+// Documents with the same name sent in the same second used to share a media store key, so
+// the second overwrote the first, or deleted it when its content turned out to be stored already
+func TestSQLSameNameSameSecond(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLite(t)
+	sent := time.Unix(1700000000, 0)
+
+	document := func(messageID int) MediaInfo {
+		return MediaInfo{
+			MessageInfo: MessageInfo{MessageID: messageID, ChatID: 1, UserID: 1, Username: "user", Timestamp: sent},
+			Kind:        MediaDocument,
+			FileName:    "scan.pdf",
+		}
+	}
+	save := func(info MediaInfo, content string) {
+		t.Helper()
+		if err := s.SaveMediaFile(ctx, info, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Stored first in another chat, so message 3's content is a duplicate
+	other := document(1)
+	other.ChatID = 2
+	save(other, "second scan")
+
+	save(document(2), "first scan")
+	save(document(3), "second scan")
+
+	if got := readMedia(t, s, 1, 2); got != "first scan" {
+		t.Errorf("message 2 reads %q, want its own content", got)
+	}
+	if got := readMedia(t, s, 1, 3); got != "second scan" {
+		t.Errorf("message 3 reads %q, want its own content", got)
+	}
+}
+
+// gatedReader signals started on its first read and then waits for gate to close
+type gatedReader struct {
+	reader  io.Reader
+	started chan struct{}
+	gate    chan struct{}
+	once    sync.Once
+}
+
+func newGatedReader(content string) *gatedReader {
+	return &gatedReader{reader: strings.NewReader(content), started: make(chan struct{}), gate: make(chan struct{})}
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		close(r.started)
+		<-r.gate
+	})
+	return r.reader.Read(p)
+}
+
+// Two copies of a message saved at once both pass the duplicate check; the one that loses
+// must not remove the content the other stored
+func TestSQLConcurrentDuplicateMedia(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLite(t)
+	media := MediaInfo{MessageInfo: testInfo(1, 10), Kind: MediaDocument, FileName: "scan.pdf"}
+
+	first, second := newGatedReader("content"), newGatedReader("content")
+	errs := make(chan error, 2)
+	go func() { errs <- s.SaveMediaFile(ctx, media, first) }()
+	go func() { errs <- s.SaveMediaFile(ctx, media, second) }()
+	<-first.started
+	<-second.started
+
+	close(first.gate)
+	if err := <-errs; err != nil {
+		t.Fatalf("first save returned %v", err)
+	}
+	close(second.gate)
+	if err := <-errs; !errors.Is(err, ErrDuplicateMessage) {
+		t.Errorf("second save returned %v, want ErrDuplicateMessage", err)
+	}
+
+	if got := readMedia(t, s, 1, 10); got != "content" {
+		t.Errorf("message 10 reads %q, want the stored content", got)
+	}
+}
+
+func TestSQLiteMigratesEmptyFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "messages.db")
+	if err := os.WriteFile(dbPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func() *SQLStorage {
+		t.Helper()
+		s, err := NewSQLiteStorage(dbPath, NewFileMediaStore(dir), false, newTestLogger(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var version int
+		if err := s.db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		if version != len(sqliteMigrations) {
+			t.Errorf("schema version %d, want %d", version, len(sqliteMigrations))
+		}
+		return s
+	}
+
+	s := open()
+	if err := s.SaveTextMessage(ctx, TextMessage{MessageInfo: testInfo(1, 10), Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Reopening finds nothing left to migrate and keeps what was stored
+	s = open()
+	defer s.Close()
+	if stored, err := s.HasMessage(ctx, 1, 10); err != nil || !stored {
+		t.Errorf("HasMessage after reopening = %v, %v", stored, err)
+	}
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"telegram-message-receiver/logger"
+)
+
+// sqliteMigrations build the SQLite schema step by step, as it grew
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		chat_id    INTEGER PRIMARY KEY,
+		username   TEXT NOT NULL,
+		first_seen INTEGER NOT NULL,
+		last_seen  INTEGER NOT NULL
+	);
+
+	CREATE TABLE contacts (
+		chat_id      INTEGER PRIMARY KEY REFERENCES users(chat_id),
+		phone_number TEXT NOT NULL,
+		created_at   INTEGER NOT NULL
+	);
+
+	CREATE TABLE messages (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		chat_id    INTEGER NOT NULL REFERENCES users(chat_id),
+		kind       TEXT NOT NULL,
+		text       TEXT,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX messages_chat_created ON messages(chat_id, created_at);
+
+	CREATE TABLE media (
+		message_id INTEGER PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+		file_name  TEXT NOT NULL,
+		path       TEXT,
+		data       BLOB,
+		size       INTEGER NOT NULL
+	);`,
+	`ALTER TABLE messages ADD COLUMN telegram_message_id INTEGER;
+	ALTER TABLE messages ADD COLUMN user_id INTEGER;
+	ALTER TABLE messages ADD COLUMN reply_to_id INTEGER;`,
+	`CREATE UNIQUE INDEX messages_chat_message ON messages(chat_id, telegram_message_id)
+		WHERE telegram_message_id IS NOT NULL;
+
+	CREATE TABLE state (
+		key   TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);`,
+	`CREATE TABLE transcripts (
+		message_id INTEGER PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+		text       TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);`,
+	`CREATE TABLE voice_variants (
+		message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+		format     TEXT NOT NULL,
+		path       TEXT,
+		data       BLOB,
+		size       INTEGER NOT NULL,
+		PRIMARY KEY (message_id, format)
+	);
+
+	CREATE TABLE voice_info (
+		message_id INTEGER PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+		metadata   TEXT NOT NULL
+	);`,
+	`ALTER TABLE voice_info ADD COLUMN sha256 TEXT;
+	CREATE INDEX voice_info_sha256 ON voice_info(sha256);`,
+	`CREATE TABLE media_content (
+		sha256    TEXT PRIMARY KEY,
+		file_name TEXT NOT NULL,
+		path      TEXT,
+		data      BLOB,
+		size      INTEGER NOT NULL
+	);
+
+	ALTER TABLE media ADD COLUMN sha256 TEXT REFERENCES media_content(sha256);
+	ALTER TABLE media ADD COLUMN file_unique_id TEXT;
+	CREATE INDEX media_sha256 ON media(sha256);
+	CREATE INDEX media_file_unique_id ON media(file_unique_id);`,
+	`ALTER TABLE messages ADD COLUMN outbound INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE TABLE blocked_chats (
+		chat_id    INTEGER PRIMARY KEY,
+		created_at INTEGER NOT NULL
+	);`,
+	`CREATE TABLE handled_messages (
+		chat_id             INTEGER NOT NULL,
+		telegram_message_id INTEGER NOT NULL,
+		created_at          INTEGER NOT NULL,
+		PRIMARY KEY (chat_id, telegram_message_id)
+	);`,
+}
+
+// NewSQLiteStorage opens, creating it if needed, the SQLite database at dbPath
+func NewSQLiteStorage(dbPath string, media MediaStore, storeBlobs bool, logger *logger.Logger) (*SQLStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(dbPath), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Transactions take the write lock when they begin: one that reads before it writes would
+	// otherwise fail with SQLITE_BUSY, rather than wait, if another connection wrote in between
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(wal)&_txlock=immediate", dbPath)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	return newSQLStorage(db, sqlDialect{name: "sqlite", migrations: sqliteMigrations}, media, storeBlobs, logger)
+}
@@ -1,20 +1,113 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"telegram-message-receiver/logger"
+	"telegram-message-receiver/metrics"
 )
 
+// MessageStorage persists received messages. Saving a message whose chat and message ID
+// were already stored returns ErrDuplicateMessage and leaves the stored copy untouched.
 type MessageStorage interface {
-	SaveVoiceMessage(chatID int64, username string, reader io.Reader, timestamp time.Time) error
-	SaveTextMessage(chatID int64, username string, text string, timestamp time.Time) error
-	SaveContactInfo(chatID int64, username string, phoneNumber string, timestamp time.Time) error
-	HasContactInfo(chatID int64) (bool, error)
+	// SaveVoiceMessage stores a recording together with its metadata and the SHA-256 checksum
+	// of its content, which is computed while the recording is written
+	SaveVoiceMessage(ctx context.Context, voice VoiceInfo, reader io.Reader) error
+	SaveTextMessage(ctx context.Context, message TextMessage) error
+	SaveMediaFile(ctx context.Context, media MediaInfo, reader io.Reader) error
+	// SaveMediaReference stores a message whose attachment has the same Telegram file unique ID
+	// as one stored before, sharing the stored content instead of downloading it again. It
+	// returns false and stores nothing if no content is stored for that ID.
+	SaveMediaReference(ctx context.Context, media MediaInfo) (bool, error)
+	// SaveVoiceReference is SaveMediaReference for voice messages
+	SaveVoiceReference(ctx context.Context, voice VoiceInfo) (bool, error)
+	// DeleteMedia removes the attachment of a stored message. Content shared with other messages
+	// is kept until the last message referencing it is deleted.
+	DeleteMedia(ctx context.Context, chatID int64, messageID int) error
+	SaveContactInfo(ctx context.Context, chatID int64, username string, phoneNumber string, timestamp time.Time) error
+	HasContactInfo(ctx context.Context, chatID int64) (bool, error)
+	HasMessage(ctx context.Context, chatID int64, messageID int) (bool, error)
+	// RecordMessage marks a message that isn't stored, such as a command, as handled so that
+	// HasMessage reports it. It returns ErrDuplicateMessage if the message was handled before.
+	RecordMessage(ctx context.Context, chatID int64, messageID int) error
+	// LoadUpdateOffset returns the last acknowledged update ID, or 0 if none was saved
+	LoadUpdateOffset(ctx context.Context) (int, error)
+	SaveUpdateOffset(ctx context.Context, updateID int) error
+	// Check returns an error if the storage can't currently accept writes
+	Check(ctx context.Context) error
+	// SaveVoiceVariant stores a copy of a saved voice message converted to another format, e.g. "wav",
+	// and adds the format to the message's metadata
+	SaveVoiceVariant(ctx context.Context, info MessageInfo, format string, reader io.Reader) error
+	// SaveTranscript stores the text of a voice message that was saved before
+	SaveTranscript(ctx context.Context, info MessageInfo, transcript string) error
+	// ListChats returns every chat with a stored message or contact, most recently seen first
+	ListChats(ctx context.Context) ([]Chat, error)
+	// GetContact returns the contact a user shared, or ErrContactNotFound
+	GetContact(ctx context.Context, chatID int64) (ContactInfo, error)
+	// ListMessages returns a page of the messages selected by filter, in the order they were received
+	ListMessages(ctx context.Context, filter MessageFilter) ([]Message, error)
+	// GetMedia opens the attachment of a stored message, or returns ErrMediaNotFound
+	GetMedia(ctx context.Context, chatID int64, messageID int) (*Media, error)
+	// CountMessages returns how many messages were received from users, by kind; replies sent
+	// by the bot aren't counted
+	CountMessages(ctx context.Context) (map[MessageKind]int, error)
+	// SetBlocked blocks or unblocks a chat. Messages from blocked chats are dropped unstored.
+	SetBlocked(ctx context.Context, chatID int64, blocked bool) error
+	IsBlocked(ctx context.Context, chatID int64) (bool, error)
+	// Close flushes pending writes and releases resources; the storage must not be used afterwards
+	Close() error
+}
+
+// MediaKind identifies the type of a media attachment
+type MediaKind string
+
+const (
+	MediaPhoto     MediaKind = "photo"
+	MediaDocument  MediaKind = "document"
+	MediaAudio     MediaKind = "audio"
+	MediaVideo     MediaKind = "video"
+	MediaVideoNote MediaKind = "video_note"
+)
+
+// Folder returns the directory name media of this kind is stored under
+func (k MediaKind) Folder() string {
+	return string(k) + "s"
+}
+
+// MessageInfo identifies a message and its sender
+type MessageInfo struct {
+	MessageID int       `json:"message_id"`
+	ChatID    int64     `json:"chat_id"`
+	UserID    int64     `json:"user_id"`
+	Username  string    `json:"username"`
+	Timestamp time.Time `json:"timestamp"`
+	ReplyToID int       `json:"reply_to_id,omitempty"`
+	// Outbound is set on replies the bot sent on an operator's behalf; UserID is then the bot's
+	Outbound bool `json:"outbound,omitempty"`
+}
+
+// MediaInfo describes a media attachment and the message it came with
+type MediaInfo struct {
+	MessageInfo
+	Kind MediaKind `json:"kind"`
+	// FileName is the attachment's original name, or empty if Telegram doesn't report one
+	FileName     string `json:"file_name"`
+	FileUniqueID string `json:"file_unique_id"`
+}
+
+// TextMessage is stored as one JSON record per line by LocalStorage
+type TextMessage struct {
+	MessageInfo
+	Text string `json:"text"`
 }
 
 type ContactInfo struct {
@@ -23,62 +116,413 @@ type ContactInfo struct {
 	Timestamp   time.Time `json:"timestamp"`
 }
 
+// VoiceInfo is the metadata of a stored voice message
+type VoiceInfo struct {
+	MessageInfo
+	FileID        string         `json:"file_id"`
+	FileUniqueID  string         `json:"file_unique_id"`
+	Duration      int            `json:"duration"`
+	MimeType      string         `json:"mime_type"`
+	FileSize      int64          `json:"file_size"`
+	Caption       string         `json:"caption,omitempty"`
+	ForwardOrigin *ForwardOrigin `json:"forward_origin,omitempty"`
+	// SHA256 is the hex checksum of the stored recording, set by storage when it is saved
+	SHA256 string `json:"sha256"`
+	// Variants lists the formats the recording was converted to and stored in besides the original
+	Variants []string `json:"variants,omitempty"`
+}
+
+// ForwardOrigin describes where a forwarded message was originally sent. Which fields are
+// set depends on whether it came from a user, a user hiding their account, or a channel.
+type ForwardOrigin struct {
+	UserID     int64     `json:"user_id,omitempty"`
+	Username   string    `json:"username,omitempty"`
+	SenderName string    `json:"sender_name,omitempty"`
+	ChatID     int64     `json:"chat_id,omitempty"`
+	ChatTitle  string    `json:"chat_title,omitempty"`
+	MessageID  int       `json:"message_id,omitempty"`
+	Signature  string    `json:"signature,omitempty"`
+	Date       time.Time `json:"date"`
+}
+
+// addVariant returns variants with format added, unless it is listed already
+func addVariant(variants []string, format string) []string {
+	for _, v := range variants {
+		if v == format {
+			return variants
+		}
+	}
+	return append(variants, format)
+}
+
+// voiceBaseName names a voice recording and the files derived from it. The message ID keeps
+// names unique when several recordings arrive within the same second.
+func voiceBaseName(info MessageInfo) string {
+	if info.MessageID == 0 {
+		return strconv.FormatInt(info.Timestamp.Unix(), 10)
+	}
+	return fmt.Sprintf("%d_%d", info.Timestamp.Unix(), info.MessageID)
+}
+
+// LocalStorage keeps messages as plain files under basePath. It is safe for concurrent use.
+//
+// Attachments are stored once per distinct content under blobs/ and hard linked into the
+// per-chat folders, with a reference record per message under refs/<chatID>/<messageID>.json.
 type LocalStorage struct {
 	basePath string
+	locks    *pathLocks
+	index    *messageIndex
+	blobs    *blobStore
+	logger   *logger.Logger
+}
+
+func NewLocalStorage(basePath string, logger *logger.Logger) *LocalStorage {
+	locks := newPathLocks()
+
+	return &LocalStorage{
+		basePath: basePath,
+		logger:   logger,
+		locks:    locks,
+		index:    newMessageIndex(filepath.Join(basePath, "index")),
+		blobs:    newBlobStore(filepath.Join(basePath, "blobs"), locks),
+	}
 }
 
-func NewLocalStorage(basePath string) *LocalStorage {
-	return &LocalStorage{basePath: basePath}
+// mediaRef records which blob holds a stored message's attachment and where it was linked
+type mediaRef struct {
+	SHA256 string `json:"sha256"`
+	Kind   string `json:"kind"`
+	// Path is relative to the storage path
+	Path string `json:"path"`
 }
 
-func (s *LocalStorage) SaveVoiceMessage(chatID int64, username string, reader io.Reader, timestamp time.Time) error {
-	voiceFolder := filepath.Join(s.basePath, "voices", fmt.Sprintf("%d_%s", chatID, username))
-	log.Printf("Saving voice message to %s", voiceFolder)
-	if err := os.MkdirAll(voiceFolder, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create directory: %v", err)
+// recordMessage records the message in the index and runs save, unless the message was stored
+// before. It is indexed first, and taken out again if save fails, so a message that was saved is
+// never missing from the index and stored a second time when its update is replayed. Saves for
+// the same chat are serialized so a replayed update can't race the original.
+func (s *LocalStorage) recordMessage(info MessageInfo, save func() error) error {
+	if info.MessageID == 0 {
+		return save()
 	}
 
-	filePath := filepath.Join(voiceFolder, fmt.Sprintf("%d.ogg", timestamp.Unix()))
-	file, err := os.Create(filePath)
+	unlock := s.locks.lock(s.index.path(info.ChatID))
+	defer unlock()
+
+	seen, err := s.index.has(info.ChatID, info.MessageID)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
+		return err
+	}
+	if seen {
+		return ErrDuplicateMessage
+	}
+
+	if err := s.index.add(info.ChatID, info.MessageID); err != nil {
+		return err
+	}
+	if err := save(); err != nil {
+		if removeErr := s.index.remove(info.ChatID, info.MessageID); removeErr != nil {
+			return errors.Join(err, removeErr)
+		}
+		return err
 	}
-	defer file.Close()
+	return nil
+}
+
+func (s *LocalStorage) HasMessage(ctx context.Context, chatID int64, messageID int) (bool, error) {
+	return s.index.has(chatID, messageID)
+}
+
+// RecordMessage adds the message to the index without storing anything
+func (s *LocalStorage) RecordMessage(ctx context.Context, chatID int64, messageID int) error {
+	return s.recordMessage(MessageInfo{ChatID: chatID, MessageID: messageID}, func() error { return nil })
+}
+
+func (s *LocalStorage) SaveVoiceMessage(ctx context.Context, voice VoiceInfo, reader io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.recordMessage(voice.MessageInfo, func() error {
+		return s.saveVoiceFile(ctx, voice, reader)
+	})
+}
 
-	_, err = io.Copy(file, reader)
+func (s *LocalStorage) SaveVoiceReference(ctx context.Context, voice VoiceInfo) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if voice.FileUniqueID == "" {
+		return false, nil
+	}
+
+	err := s.recordMessage(voice.MessageInfo, func() error {
+		blob, err := s.blobs.acquire(voice.FileUniqueID)
+		if err != nil {
+			return err
+		}
+		return s.storeVoice(ctx, voice, blob)
+	})
+	if errors.Is(err, errBlobNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalStorage) saveVoiceFile(ctx context.Context, voice VoiceInfo, reader io.Reader) error {
+	blob, err := s.blobs.put(ctx, reader, "voice.ogg", voice.FileUniqueID)
 	if err != nil {
-		return fmt.Errorf("failed to save voice message: %v", err)
+		return fmt.Errorf("failed to save voice message: %w", err)
 	}
+	return s.storeVoice(ctx, voice, blob)
+}
 
-	fmt.Printf("Voice message saved: %s\n", filePath)
+// storeVoice links a blob in as the recording of a voice message, <name>.ogg, and writes the
+// message's metadata to a JSON sidecar next to it, as <name>.json. The recording is removed
+// again if the sidecar can't be written.
+func (s *LocalStorage) storeVoice(ctx context.Context, voice VoiceInfo, blob blobRecord) error {
+	filePath, err := s.addRef(voice.MessageInfo, kindVoice, blob, filepath.Join(s.voiceFolder(voice.MessageInfo), voiceBaseName(voice.MessageInfo)+".ogg"))
+	if err != nil {
+		return fmt.Errorf("failed to save voice message: %w", err)
+	}
+	voice.SHA256 = blob.SHA256
+
+	infoPath := s.voiceInfoPath(voice.MessageInfo)
+	unlock := s.locks.lock(infoPath)
+	defer unlock()
+
+	if err := writeJSONAtomic(infoPath, voice); err != nil {
+		s.removeRef(voice.MessageInfo, blob.SHA256, filePath)
+		return fmt.Errorf("failed to save voice info: %w", err)
+	}
+
+	metrics.MessagesStored.WithLabelValues(kindVoice).Inc()
+	logger.FromContext(ctx, s.logger).Info("Voice message saved", "path", filePath, "sha256", voice.SHA256)
 	return nil
 }
 
-func (s *LocalStorage) SaveTextMessage(chatID int64, username string, text string, timestamp time.Time) error {
-	textFolder := filepath.Join(s.basePath, "texts")
-	log.Println(textFolder)
+// SaveTranscript writes the transcript of a voice message next to its recording, as <name>.txt
+func (s *LocalStorage) SaveTranscript(ctx context.Context, info MessageInfo, transcript string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	filePath := filepath.Join(s.voiceFolder(info), voiceBaseName(info)+".txt")
+	if err := writeFileAtomic(filePath, []byte(transcript+"\n")); err != nil {
+		return fmt.Errorf("failed to save transcript: %w", err)
+	}
+
+	logger.FromContext(ctx, s.logger).Info("Transcript saved", "path", filePath)
+	return nil
+}
+
+// SaveVoiceVariant writes a converted copy of a voice message next to its recording, as
+// <name>.<format>, and lists the format in the recording's sidecar
+func (s *LocalStorage) SaveVoiceVariant(ctx context.Context, info MessageInfo, format string, reader io.Reader) error {
+	filePath := filepath.Join(s.voiceFolder(info), voiceBaseName(info)+"."+format)
+	if _, err := writeFile(ctx, filePath, reader); err != nil {
+		return fmt.Errorf("failed to save %s variant: %w", format, err)
+	}
+
+	infoPath := s.voiceInfoPath(info)
+	unlock := s.locks.lock(infoPath)
+	defer unlock()
+
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		return fmt.Errorf("failed to read voice info: %w", err)
+	}
+	var voice VoiceInfo
+	if err := json.Unmarshal(data, &voice); err != nil {
+		return fmt.Errorf("failed to decode voice info: %w", err)
+	}
+
+	voice.Variants = addVariant(voice.Variants, format)
+	if err := writeJSONAtomic(infoPath, voice); err != nil {
+		return fmt.Errorf("failed to save voice info: %w", err)
+	}
+
+	logger.FromContext(ctx, s.logger).Info("Voice variant saved", "format", format, "path", filePath)
+	return nil
+}
+
+func (s *LocalStorage) voiceInfoPath(info MessageInfo) string {
+	return filepath.Join(s.voiceFolder(info), voiceBaseName(info)+".json")
+}
+
+func (s *LocalStorage) voiceFolder(info MessageInfo) string {
+	return filepath.Join(s.basePath, "voices", fmt.Sprintf("%d_%s", info.ChatID, info.Username))
+}
+
+func (s *LocalStorage) SaveTextMessage(ctx context.Context, message TextMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	textFolder := filepath.Join(s.basePath, "texts", fmt.Sprintf("%d_%s", message.ChatID, message.Username))
 	if err := os.MkdirAll(textFolder, os.ModePerm); err != nil {
 		return fmt.Errorf("failed to create directory: %v", err)
 	}
 
-	filePath := filepath.Join(textFolder, fmt.Sprintf("%d.txt", timestamp.Unix()))
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	filePath := filepath.Join(textFolder, message.Timestamp.UTC().Format("2006-01-02")+".jsonl")
+
+	return s.recordMessage(message.MessageInfo, func() error {
+		unlock := s.locks.lock(filePath)
+		defer unlock()
+
+		if err := appendJSONLine(filePath, message); err != nil {
+			return fmt.Errorf("failed to write message: %w", err)
+		}
+
+		metrics.MessagesStored.WithLabelValues(kindText).Inc()
+		logger.FromContext(ctx, s.logger).Info("Text message saved", "path", filePath)
+		return nil
+	})
+}
+
+func (s *LocalStorage) SaveMediaFile(ctx context.Context, media MediaInfo, reader io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.recordMessage(media.MessageInfo, func() error {
+		blob, err := s.blobs.put(ctx, reader, media.FileName, media.FileUniqueID)
+		if err != nil {
+			return fmt.Errorf("failed to save %s: %w", media.Kind, err)
+		}
+		return s.storeMedia(ctx, media, blob)
+	})
+}
+
+func (s *LocalStorage) SaveMediaReference(ctx context.Context, media MediaInfo) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if media.FileUniqueID == "" {
+		return false, nil
+	}
+
+	err := s.recordMessage(media.MessageInfo, func() error {
+		blob, err := s.blobs.acquire(media.FileUniqueID)
+		if err != nil {
+			return err
+		}
+		return s.storeMedia(ctx, media, blob)
+	})
+	if errors.Is(err, errBlobNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// storeMedia links a blob into the folder for the media's kind and chat
+func (s *LocalStorage) storeMedia(ctx context.Context, media MediaInfo, blob blobRecord) error {
+	fileName := media.FileName
+	if fileName == "" {
+		fileName = blob.FileName
+	}
+
+	// Prefix with the timestamp so files with the same original name don't overwrite each other
+	mediaFolder := filepath.Join(s.basePath, media.Kind.Folder(), fmt.Sprintf("%d_%s", media.ChatID, media.Username))
+	filePath, err := s.addRef(media.MessageInfo, string(media.Kind), blob,
+		filepath.Join(mediaFolder, fmt.Sprintf("%d_%s", media.Timestamp.Unix(), sanitizeFileName(fileName))))
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", media.Kind, err)
+	}
+
+	metrics.MessagesStored.WithLabelValues(string(media.Kind)).Inc()
+	logger.FromContext(ctx, s.logger).Info("Media file saved", "kind", media.Kind, "path", filePath, "sha256", blob.SHA256)
+	return nil
+}
+
+// addRef links a blob, which the caller holds a reference to, into path and records it as the
+// attachment of the message. The reference is released again on failure.
+func (s *LocalStorage) addRef(info MessageInfo, kind string, blob blobRecord, path string) (string, error) {
+	filePath, err := s.blobs.link(blob.SHA256, path)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %v", err)
+		s.blobs.release(blob.SHA256)
+		return "", err
 	}
-	defer file.Close()
 
-	messageEntry := fmt.Sprintf("[%s]: %s\n", timestamp.Format(time.RFC3339), text)
+	// Without a message ID there is nothing to look the attachment up by, so it can't be deleted either
+	if info.MessageID == 0 {
+		return filePath, nil
+	}
 
-	if _, err := file.WriteString(messageEntry); err != nil {
-		return fmt.Errorf("failed to write message: %v", err)
+	relPath, err := filepath.Rel(s.basePath, filePath)
+	if err == nil {
+		refPath := s.refPath(info.ChatID, info.MessageID)
+		if err = os.MkdirAll(filepath.Dir(refPath), os.ModePerm); err == nil {
+			err = writeJSONAtomic(refPath, mediaRef{SHA256: blob.SHA256, Kind: kind, Path: relPath})
+		}
+	}
+	if err != nil {
+		os.Remove(filePath)
+		s.blobs.release(blob.SHA256)
+		return "", fmt.Errorf("failed to save reference record: %w", err)
 	}
+	return filePath, nil
+}
+
+// removeRef undoes addRef
+func (s *LocalStorage) removeRef(info MessageInfo, checksum, filePath string) {
+	os.Remove(filePath)
+	if info.MessageID != 0 {
+		os.Remove(s.refPath(info.ChatID, info.MessageID))
+	}
+	s.blobs.release(checksum)
+}
+
+// DeleteMedia removes the attachment of a message and, for a voice message, the sidecar,
+// transcript and converted copies stored next to the recording. Files stored before content
+// was deduplicated have no reference record and return ErrMediaNotFound.
+func (s *LocalStorage) DeleteMedia(ctx context.Context, chatID int64, messageID int) error {
+	refPath := s.refPath(chatID, messageID)
+	unlock := s.locks.lock(refPath)
+	defer unlock()
 
-	fmt.Printf("Text message saved: %s\n", filePath)
+	data, err := os.ReadFile(refPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrMediaNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read reference record: %w", err)
+	}
+	var ref mediaRef
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return fmt.Errorf("failed to decode reference record: %w", err)
+	}
+
+	filePath := filepath.Join(s.basePath, ref.Path)
+	paths := []string{filePath}
+	if ref.Kind == kindVoice {
+		derived, err := derivedFiles(filePath)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, derived...)
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+
+	if err := os.Remove(refPath); err != nil {
+		return fmt.Errorf("failed to remove reference record: %w", err)
+	}
+	if err := s.blobs.release(ref.SHA256); err != nil {
+		return fmt.Errorf("failed to release content: %w", err)
+	}
+
+	logger.FromContext(ctx, s.logger).Info("Media deleted", "kind", ref.Kind, "path", filePath)
 	return nil
 }
 
-func (s *LocalStorage) HasContactInfo(chatID int64) (bool, error) {
+func (s *LocalStorage) refPath(chatID int64, messageID int) string {
+	return filepath.Join(s.basePath, "refs", strconv.FormatInt(chatID, 10), strconv.Itoa(messageID)+".json")
+}
+
+func (s *LocalStorage) HasContactInfo(ctx context.Context, chatID int64) (bool, error) {
 	filePath := filepath.Join(s.basePath, "contacts", fmt.Sprintf("%d.json", chatID))
 	_, err := os.Stat(filePath)
 	if os.IsNotExist(err) {
@@ -90,7 +534,11 @@ func (s *LocalStorage) HasContactInfo(chatID int64) (bool, error) {
 	return true, nil
 }
 
-func (s *LocalStorage) SaveContactInfo(chatID int64, username string, phoneNumber string, timestamp time.Time) error {
+func (s *LocalStorage) SaveContactInfo(ctx context.Context, chatID int64, username string, phoneNumber string, timestamp time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	contactsFolder := filepath.Join(s.basePath, "contacts")
 	if err := os.MkdirAll(contactsFolder, os.ModePerm); err != nil {
 		return fmt.Errorf("failed to create directory: %v", err)
@@ -109,9 +557,85 @@ func (s *LocalStorage) SaveContactInfo(chatID int64, username string, phoneNumbe
 		return fmt.Errorf("failed to marshal contact info: %v", err)
 	}
 
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
+	unlock := s.locks.lock(filePath)
+	defer unlock()
+
+	if err := writeFileAtomic(filePath, data); err != nil {
 		return fmt.Errorf("failed to save contact info: %v", err)
 	}
 
+	metrics.MessagesStored.WithLabelValues(kindContact).Inc()
+	return nil
+}
+
+func (s *LocalStorage) LoadUpdateOffset(ctx context.Context) (int, error) {
+	data, err := os.ReadFile(filepath.Join(s.basePath, "state", "update_offset"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read update offset: %w", err)
+	}
+
+	offset, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid update offset: %w", err)
+	}
+	return offset, nil
+}
+
+func (s *LocalStorage) SaveUpdateOffset(ctx context.Context, updateID int) error {
+	stateFolder := filepath.Join(s.basePath, "state")
+	if err := os.MkdirAll(stateFolder, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	if err := writeFileAtomic(filepath.Join(stateFolder, "update_offset"), []byte(strconv.Itoa(updateID))); err != nil {
+		return fmt.Errorf("failed to save update offset: %w", err)
+	}
+	return nil
+}
+
+// SetBlocked marks a blocked chat with an empty file under blocked/
+func (s *LocalStorage) SetBlocked(ctx context.Context, chatID int64, blocked bool) error {
+	filePath := s.blockedPath(chatID)
+	if !blocked {
+		if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to unblock chat: %w", err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := writeFileAtomic(filePath, nil); err != nil {
+		return fmt.Errorf("failed to block chat: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) IsBlocked(ctx context.Context, chatID int64) (bool, error) {
+	_, err := os.Stat(s.blockedPath(chatID))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking blocked chat: %w", err)
+	}
+	return true, nil
+}
+
+func (s *LocalStorage) blockedPath(chatID int64) string {
+	return filepath.Join(s.basePath, "blocked", strconv.FormatInt(chatID, 10))
+}
+
+// Check verifies that files can be created under the storage path
+func (s *LocalStorage) Check(ctx context.Context) error {
+	return checkWritable(s.basePath)
+}
+
+// Close is a no-op: every write is synced to disk before the save call returns
+func (s *LocalStorage) Close() error {
 	return nil
 }
@@ -0,0 +1,79 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// formatArgs are the ffmpeg output options for each supported target format
+var formatArgs = map[string][]string{
+	// 16 kHz mono PCM, the input speech recognizers such as whisper.cpp expect
+	"wav": {"-ar", "16000", "-ac", "1", "-c:a", "pcm_s16le"},
+	"mp3": {"-c:a", "libmp3lame", "-q:a", "4"},
+}
+
+// SupportedFormats lists the target formats FFmpeg can produce
+func SupportedFormats() []string {
+	formats := make([]string, 0, len(formatArgs))
+	for format := range formatArgs {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// FFmpeg converts audio files by running an ffmpeg binary
+type FFmpeg struct {
+	binary  string
+	formats []string
+}
+
+// NewFFmpeg creates a transcoder producing each of formats with the given ffmpeg binary
+func NewFFmpeg(binary string, formats []string) (*FFmpeg, error) {
+	for _, format := range formats {
+		if _, ok := formatArgs[format]; !ok {
+			return nil, fmt.Errorf("unsupported format %q: must be one of %s", format, strings.Join(SupportedFormats(), ", "))
+		}
+	}
+
+	return &FFmpeg{
+		binary:  binary,
+		formats: formats,
+	}, nil
+}
+
+// Formats returns the target formats, in the order they were configured
+func (f *FFmpeg) Formats() []string {
+	return f.formats
+}
+
+// Transcode converts the audio file at inputPath to format, writing it to outputPath
+func (f *FFmpeg) Transcode(ctx context.Context, inputPath, format, outputPath string) error {
+	args, ok := formatArgs[format]
+	if !ok {
+		return fmt.Errorf("unsupported format %q", format)
+	}
+
+	cmdArgs := []string{"-nostdin", "-hide_banner", "-loglevel", "error", "-y", "-i", inputPath}
+	cmdArgs = append(cmdArgs, args...)
+	cmdArgs = append(cmdArgs, "-f", format, outputPath)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.binary, cmdArgs...)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if detail := strings.TrimSpace(stderr.String()); detail != "" {
+			return fmt.Errorf("ffmpeg failed to produce %s: %w: %s", format, err, detail)
+		}
+		return fmt.Errorf("ffmpeg failed to produce %s: %w", format, err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package transcribe
+
+import (
+	"context"
+	"sync"
+)
+
+// Fake is a Transcriber for tests and local runs without a speech engine. It returns Text,
+// or Err if set, and records the paths it was asked to transcribe.
+type Fake struct {
+	Text string
+	Err  error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *Fake) Transcribe(ctx context.Context, audioPath string) (string, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, audioPath)
+	f.mu.Unlock()
+
+	if f.Err != nil {
+		return "", f.Err
+	}
+	return f.Text, nil
+}
+
+// Calls returns the audio paths passed to Transcribe so far
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.calls...)
+}
@@ -0,0 +1,11 @@
+package transcribe
+
+import (
+	"context"
+)
+
+// Transcriber turns a recorded voice message into text
+type Transcriber interface {
+	// Transcribe returns the text spoken in the audio file at audioPath
+	Transcribe(ctx context.Context, audioPath string) (string, error)
+}
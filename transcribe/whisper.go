@@ -0,0 +1,67 @@
+package transcribe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Whisper transcribes audio by running a locally installed whisper.cpp binary. The binary
+// must be able to read the audio format it is given; for Telegram's OGG/Opus voice notes
+// that means a build with ffmpeg support.
+type Whisper struct {
+	binary   string
+	model    string
+	language string
+}
+
+// NewWhisper creates a transcriber running binary with the given model file. language is a
+// language code such as "en", or "auto" to let whisper detect it.
+func NewWhisper(binary, model, language string) *Whisper {
+	return &Whisper{
+		binary:   binary,
+		model:    model,
+		language: language,
+	}
+}
+
+func (w *Whisper) Transcribe(ctx context.Context, audioPath string) (string, error) {
+	// -nt leaves timestamps out and -np keeps progress output off stdout, so stdout is just the text
+	cmd := exec.CommandContext(ctx, w.binary,
+		"-m", w.model,
+		"-l", w.language,
+		"-nt", "-np",
+		"-f", audioPath,
+	)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if detail := lastLine(stderr.String()); detail != "" {
+			return "", fmt.Errorf("whisper failed: %w: %s", err, detail)
+		}
+		return "", fmt.Errorf("whisper failed: %w", err)
+	}
+
+	return normalize(stdout.String()), nil
+}
+
+// normalize joins the segments whisper prints on separate lines into one paragraph
+func normalize(output string) string {
+	return strings.Join(strings.Fields(output), " ")
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
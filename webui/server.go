@@ -0,0 +1,337 @@
+package webui
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"telegram-message-receiver/api"
+	"telegram-message-receiver/logger"
+	"telegram-message-receiver/storage"
+)
+
+// pageSize is the number of messages shown per page
+const pageSize = 50
+
+//go:embed templates static
+var files embed.FS
+
+// Server serves a read-only inbox of the stored chats as server-rendered HTML, behind HTTP
+// basic auth
+type Server struct {
+	addr     string
+	username string
+	password string
+	storage  storage.MessageStorage
+	logger   *logger.Logger
+	pages    map[string]*template.Template
+	server   *http.Server
+}
+
+func NewServer(addr, username, password string, storage storage.MessageStorage, logger *logger.Logger) (*Server, error) {
+	pages := make(map[string]*template.Template)
+	for _, page := range []string{"inbox.html", "chat.html", "search.html"} {
+		tmpl, err := template.New(page).Funcs(funcs).ParseFS(files, "templates/layout.html", "templates/messages.html", "templates/"+page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", page, err)
+		}
+		pages[page] = tmpl
+	}
+
+	return &Server{
+		addr:     addr,
+		username: username,
+		password: password,
+		storage:  storage,
+		logger:   logger,
+		pages:    pages,
+	}, nil
+}
+
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+
+	static, err := fs.Sub(files, "static")
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.inbox)
+	mux.HandleFunc("/chats/", s.chat)
+	mux.HandleFunc("/search", s.search)
+	mux.HandleFunc("/media/", s.media)
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
+	s.server = &http.Server{
+		Handler:           s.authorize(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Web UI server stopped", "error", err)
+		}
+	}()
+
+	s.logger.Info("Serving web UI", "addr", s.addr)
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	if err := s.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down web UI server: %w", err)
+	}
+	return nil
+}
+
+// authorize asks for the configured credentials with HTTP basic auth
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(s.username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="inbox", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// inboxPage lists the chats
+type inboxPage struct {
+	Title string
+	Query string
+	Chats []storage.Chat
+}
+
+func (s *Server) inbox(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	chats, err := s.storage.ListChats(r.Context())
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	s.render(w, r, "inbox.html", inboxPage{Title: "Inbox", Chats: chats})
+}
+
+// chatPage shows a page of a conversation, oldest message first
+type chatPage struct {
+	Title    string
+	Query    string
+	Chat     storage.Chat
+	Messages []storage.Message
+	// Older and Newer are the numbers of the neighbouring pages, or -1 if there is none
+	Older int
+	Newer int
+}
+
+// chat shows /chats/{chatID}. Page 0 holds the latest messages, higher pages older ones.
+func (s *Server) chat(w http.ResponseWriter, r *http.Request) {
+	chatID, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/chats/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	pageNumber := pageParam(r)
+
+	chat, err := s.findChat(r.Context(), chatID)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if chat == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	messages, err := s.storage.ListMessages(r.Context(), storage.MessageFilter{
+		ChatID:      chatID,
+		Search:      query,
+		Limit:       pageSize,
+		Offset:      pageNumber * pageSize,
+		NewestFirst: true,
+	})
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	page := chatPage{Title: chatTitle(*chat), Query: query, Chat: *chat, Messages: messages, Older: -1, Newer: pageNumber - 1}
+	if len(messages) == pageSize {
+		page.Older = pageNumber + 1
+	}
+	s.render(w, r, "chat.html", page)
+}
+
+// searchPage lists the messages of all chats matching a search, newest first
+type searchPage struct {
+	Title    string
+	Query    string
+	Messages []storage.Message
+	// Chats maps chat IDs to their names, for labelling results
+	Chats map[int64]string
+	Page  int
+	More  bool
+}
+
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	page := searchPage{Title: "Search", Query: query, Page: pageParam(r)}
+	if query == "" {
+		s.render(w, r, "search.html", page)
+		return
+	}
+
+	messages, err := s.storage.ListMessages(r.Context(), storage.MessageFilter{
+		Search:      query,
+		Limit:       pageSize,
+		Offset:      page.Page * pageSize,
+		NewestFirst: true,
+	})
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	chats, err := s.storage.ListChats(r.Context())
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	page.Title = "Search: " + query
+	page.Messages = messages
+	page.More = len(messages) == pageSize
+	page.Chats = make(map[int64]string, len(chats))
+	for _, chat := range chats {
+		page.Chats[chat.ChatID] = chatTitle(chat)
+	}
+	s.render(w, r, "search.html", page)
+}
+
+// media serves /media/{chatID}/{messageID} for the players and links of a conversation
+func (s *Server) media(w http.ResponseWriter, r *http.Request) {
+	chatParam, messageParam, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/media/"), "/")
+	chatID, err := strconv.ParseInt(chatParam, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	messageID, err := strconv.Atoi(messageParam)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	media, err := s.storage.GetMedia(r.Context(), chatID, messageID)
+	if errors.Is(err, storage.ErrMediaNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	defer media.Close()
+
+	if err := api.ServeMedia(w, r, media); err != nil {
+		s.logger.Warn("Media download interrupted", "path", r.URL.Path, "error", err)
+	}
+}
+
+// findChat returns the chat with chatID, or nil if the bot hasn't heard from it
+func (s *Server) findChat(ctx context.Context, chatID int64) (*storage.Chat, error) {
+	chats, err := s.storage.ListChats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, chat := range chats {
+		if chat.ChatID == chatID {
+			return &chat, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *Server) render(w http.ResponseWriter, r *http.Request, page string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := s.pages[page].ExecuteTemplate(w, "layout", data); err != nil {
+		s.logger.Error("Failed to render page", "page", page, "path", r.URL.Path, "error", err)
+	}
+}
+
+func (s *Server) internalError(w http.ResponseWriter, r *http.Request, err error) {
+	s.logger.Error("Web UI request failed", "path", r.URL.Path, "error", err)
+	http.Error(w, "Internal error", http.StatusInternalServerError)
+}
+
+// maxPage is the last page whose offset still fits in an int
+const maxPage = math.MaxInt / pageSize
+
+// pageParam returns the page query parameter, 0 if it is missing or invalid and at most maxPage
+func pageParam(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 0 {
+		return 0
+	}
+	return min(page, maxPage)
+}
+
+func chatTitle(chat storage.Chat) string {
+	if chat.Username != "" {
+		return "@" + chat.Username
+	}
+	return strconv.FormatInt(chat.ChatID, 10)
+}
+
+var funcs = template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format("2006-01-02 15:04 UTC")
+	},
+	"size": func(size int64) string {
+		switch {
+		case size >= 1<<20:
+			return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+		case size >= 1<<10:
+			return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+		default:
+			return fmt.Sprintf("%d B", size)
+		}
+	},
+	"add": func(a, b int) int {
+		return a + b
+	},
+	"duration": func(seconds int) string {
+		return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+	},
+}